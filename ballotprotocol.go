@@ -0,0 +1,216 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Adapted from C++ code by 2014 Stellar Development Foundation and contributors
+
+package scp
+
+import (
+	"errors"
+	"math"
+
+	"github.com/scp/types"
+)
+
+//enum
+type SCPPhase int32
+
+const (
+	SCPPhasePrepare SCPPhase = iota
+	SCPPhaseConfirm
+	SCPPhaseExternalize
+)
+
+var scpPhaseMap = map[int32]string{
+	0: "PREPARE",
+	1: "FINISH",
+	2: "EXTERNALIZE",
+}
+
+// ValidEnum validates a proposed value for this enum.  Implements
+// the Enum interface for SCPPhase
+func (e SCPPhase) ValidEnum(v int32) bool {
+	_, ok := scpPhaseMap[v]
+	return ok
+}
+
+// String returns the name of `e`
+func (e SCPPhase) String() string {
+	name, _ := scpPhaseMap[int32(e)]
+	return name
+}
+
+/**
+ * The BallotProtocol holds the state of the local node in the ballot
+ * protocol of a slot.
+ */
+type BallotProtocol struct {
+	mSlot *Slot
+
+	mPhase         SCPPhase         // Phi
+	mCurrentBallot *types.SCPBallot // b
+	mPrepared      *types.SCPBallot // p
+	mPreparedPrime *types.SCPBallot // p'
+	mHighBallot    *types.SCPBallot // h
+	mCommit        *types.SCPBallot // c
+
+	// a quorum reached the counter of the current ballot, reset when it
+	// is bumped
+	mHeardFromQuorum bool
+}
+
+func (nb *BallotProtocol) NBallotProtocol(slot *Slot) {
+	nb.mSlot = slot
+	nb.mPhase = SCPPhasePrepare
+}
+
+// ErrBallotStarted is returned when restoring the state of a slot that
+// already started balloting
+var ErrBallotStarted = errors.New("SCP: cannot set state after starting ballot protocol")
+
+func makeBallot(counter uint32, value interface{}) *types.SCPBallot {
+	return &types.SCPBallot{Counter: counter, Value: value}
+}
+
+// setStateFromEnvelope restores the ballot state of the local node from
+// the latest ballot envelope it emitted
+func (nb *BallotProtocol) setStateFromEnvelope(e types.SCPEnvelope) error {
+	if nb.mCurrentBallot != nil {
+		return ErrBallotStarted
+	}
+	return nb.setLocalState(e.Statement)
+}
+
+// setLocalState sets the ballot state of the local node to the one its
+// statement st describes
+func (nb *BallotProtocol) setLocalState(st types.SCPStatement) error {
+	switch st.Type {
+	case types.SCPStPrepare:
+		prep := &st.SCPStPrepare
+		b := prep.Ballot
+		nb.mCurrentBallot = makeBallot(b.Counter, b.Value)
+		// what the statement omits is not set, whatever the state was
+		nb.mPrepared = nil
+		nb.mPreparedPrime = nil
+		nb.mHighBallot = nil
+		nb.mCommit = nil
+		if prep.Prepared != nil {
+			nb.mPrepared = makeBallot(prep.Prepared.Counter, prep.Prepared.Value)
+		}
+		if prep.PreparedPrime != nil {
+			nb.mPreparedPrime = makeBallot(prep.PreparedPrime.Counter, prep.PreparedPrime.Value)
+		}
+		if prep.NH != 0 {
+			nb.mHighBallot = makeBallot(prep.NH, b.Value)
+		}
+		if prep.NC != 0 {
+			nb.mCommit = makeBallot(prep.NC, b.Value)
+		}
+		nb.mPhase = SCPPhasePrepare
+	case types.SCPStConfirm:
+		c := &st.SCPStConfirm
+		v := c.Ballot.Value
+		nb.mCurrentBallot = makeBallot(c.Ballot.Counter, v)
+		nb.mPreparedPrime = nil
+		nb.mPrepared = makeBallot(c.NPrepared, v)
+		nb.mHighBallot = makeBallot(c.NH, v)
+		nb.mCommit = makeBallot(c.NCommit, v)
+		nb.mPhase = SCPPhaseConfirm
+	case types.SCPStExternalize:
+		ext := &st.SCPStExternalize
+		v := ext.Commit.Value
+		nb.mCurrentBallot = makeBallot(math.MaxUint32, v)
+		nb.mPrepared = makeBallot(math.MaxUint32, v)
+		nb.mPreparedPrime = nil
+		nb.mHighBallot = makeBallot(ext.NH, v)
+		nb.mCommit = makeBallot(ext.Commit.Counter, v)
+		nb.mPhase = SCPPhaseExternalize
+	default:
+		return errInvalidRestoreEnvelope
+	}
+	return nil
+}
+
+// BallotJsonInfo is the JSON view of the ballot state of a slot, ballots
+// are rendered with ballotToStr
+type BallotJsonInfo struct {
+	Heard         bool   `json:"heard"`
+	Phase         string `json:"phase"`
+	Ballot        string `json:"ballot"`
+	Prepared      string `json:"prepared"`
+	PreparedPrime string `json:"preparedPrime"`
+	Commit        string `json:"commit"`
+	High          string `json:"high"`
+}
+
+// setLocalBallotState is setLocalState for the statements the local node
+// emits, raising the counter of its current ballot is a bump
+func (nb *BallotProtocol) setLocalBallotState(st types.SCPStatement) {
+	prev := nb.mCurrentBallot
+	nb.setLocalState(st)
+	if nb.mCurrentBallot == nil {
+		return
+	}
+	if prev == nil || nb.mCurrentBallot.Counter > prev.Counter {
+		nb.mHeardFromQuorum = false
+	}
+	if prev != nil && nb.mCurrentBallot.Counter > prev.Counter {
+		nb.mSlot.mSCP.mDriver.incCounter(MetricBallotBumps)
+	}
+}
+
+// checkHeardFromQuorum records the first time a quorum reaches the
+// counter of the current ballot
+func (nb *BallotProtocol) checkHeardFromQuorum() {
+	if nb.mHeardFromQuorum || !nb.heardFromQuorum() {
+		return
+	}
+	nb.mHeardFromQuorum = true
+	nb.mSlot.mSCP.mDriver.incCounter(MetricQuorumHeard)
+}
+
+// heardFromQuorum tells if a quorum of nodes reached the current ballot
+// counter of the local node
+func (nb *BallotProtocol) heardFromQuorum() bool {
+	if nb.mCurrentBallot == nil {
+		return false
+	}
+	slot := nb.mSlot
+	counter := nb.mCurrentBallot.Counter
+	qFun := func(st types.SCPStatement) *types.SCPQuorumSet {
+		return slot.getQuorumSetFromStatement(st)
+	}
+	filter := func(st types.SCPStatement) bool {
+		return st.Type == types.SCPStExternalize || getWorkingBallot(st).Counter >= counter
+	}
+	return IsQuorum(slot.getLocalQuorumSet(), envelopesByNodeID(slot.mLatestEnvelopes), qFun, filter)
+}
+
+func (nb *BallotProtocol) getJsonInfo() BallotJsonInfo {
+	return BallotJsonInfo{
+		Heard:         nb.heardFromQuorum(),
+		Phase:         nb.mPhase.String(),
+		Ballot:        ballotToStr(nb.mCurrentBallot),
+		Prepared:      ballotToStr(nb.mPrepared),
+		PreparedPrime: ballotToStr(nb.mPreparedPrime),
+		Commit:        ballotToStr(nb.mCommit),
+		High:          ballotToStr(nb.mHighBallot),
+	}
+}
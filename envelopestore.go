@@ -0,0 +1,354 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/scp/types"
+)
+
+// EnvelopeStore persists the envelopes signed by the local node so that it
+// never contradicts them after a restart
+type EnvelopeStore interface {
+	// Append records envelope, it returns once the envelope is as durable as
+	// the store allows
+	Append(envelope types.SCPEnvelope) error
+	// Load returns the recorded envelopes in the order they were appended
+	Load() ([]types.SCPEnvelope, error)
+	// Truncate forgets the envelopes of the slots below minSlotIndex
+	Truncate(minSlotIndex uint64) error
+	Close() error
+}
+
+//enum
+type SyncPolicy int32
+
+const (
+	SyncAlways SyncPolicy = iota // fsync after every record
+	SyncNever                    // leave flushing to the OS
+)
+
+var syncPolicyMap = map[int32]string{
+	0: "SyncAlways",
+	1: "SyncNever",
+}
+
+// ValidEnum validates a proposed value for this enum.  Implements
+// the Enum interface for SyncPolicy
+func (e SyncPolicy) ValidEnum(v int32) bool {
+	_, ok := syncPolicyMap[v]
+	return ok
+}
+
+// String returns the name of `e`
+func (e SyncPolicy) String() string {
+	name, _ := syncPolicyMap[int32(e)]
+	return name
+}
+
+// ErrEnvelopeStoreClosed is returned when using a closed store
+var ErrEnvelopeStoreClosed = errors.New("SCP: envelope store is closed")
+
+// ErrEnvelopeStoreFailed is returned by Append once a failed append could
+// not be undone, the store must be opened again
+var ErrEnvelopeStoreFailed = errors.New("SCP: envelope store failed")
+
+// CorruptEnvelopeStoreError is returned when opening a log with a damaged
+// record that is not the last one, the records after it can't be trusted
+type CorruptEnvelopeStoreError struct {
+	Offset int64 // of the damaged record
+	Reason string
+}
+
+func (e *CorruptEnvelopeStoreError) Error() string {
+	return fmt.Sprintf("SCP: envelope store corrupt at offset %d: %s", e.Offset, e.Reason)
+}
+
+// records are laid out as
+//  * payload length, 4 bytes big endian
+//  * CRC32 (Castagnoli) of the payload, 4 bytes big endian
+//  * payload, the msgpack encoded envelope
+const envelopeRecordHeaderSize = 8
+
+// largest payload accepted when reading, anything bigger is corruption
+const maxEnvelopeRecordSize = 1 << 24
+
+var envelopeRecordTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FileEnvelopeStore is an append only EnvelopeStore kept in a single file.
+// A crash while appending can only damage the last record: it is dropped
+// when the file is opened. Damage anywhere else fails the opening.
+type FileEnvelopeStore struct {
+	mPath   string
+	mPolicy SyncPolicy
+	mFile   envelopeLogFile
+	mLogger Logger
+	// set once a partial record could not be removed
+	mFailed bool
+	// envelopes in the file, in order
+	mEnvelopes []types.SCPEnvelope
+}
+
+// envelopeLogFile is what FileEnvelopeStore uses of an *os.File
+type envelopeLogFile interface {
+	io.Writer
+	io.Seeker
+	io.Closer
+	Truncate(size int64) error
+	Sync() error
+}
+
+// NFileEnvelopeStore opens the log at path, creating it if needed. A torn
+// last record is dropped and reported to logger, nil is silent. A
+// *CorruptEnvelopeStoreError is returned for any other damaged record.
+func (nf *FileEnvelopeStore) NFileEnvelopeStore(path string, policy SyncPolicy, logger Logger) error {
+	nf.mPath = path
+	nf.mPolicy = policy
+	nf.mLogger = logger
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	envelopes, size, err := readEnvelopeRecords(f, logger)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// drop the unreadable tail, if any, so that new records follow the
+	// last good one
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	nf.mFile = f
+	nf.mEnvelopes = envelopes
+	return nil
+}
+
+// Append writes envelope at the end of the log. If that fails, what was
+// written of the record is removed so that the next records follow the
+// last good one; if even that fails, ErrEnvelopeStoreFailed is returned
+// by the next appends.
+func (nf *FileEnvelopeStore) Append(envelope types.SCPEnvelope) error {
+	if nf.mFile == nil {
+		return ErrEnvelopeStoreClosed
+	}
+	if nf.mFailed {
+		return ErrEnvelopeStoreFailed
+	}
+	offset, err := nf.mFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = nf.mFile.Write(encodeEnvelopeRecord(envelope))
+	if err == nil {
+		err = nf.sync(nf.mFile)
+	}
+	if err != nil {
+		if rbErr := nf.rollback(offset); rbErr != nil {
+			logWith(nf.mLogger, LogLevelError, "envelope store can't drop a partial record",
+				Field("path", nf.mPath), Field("offset", offset), Field("error", rbErr))
+			nf.mFailed = true
+		}
+		return err
+	}
+	nf.mEnvelopes = append(nf.mEnvelopes, envelope)
+	return nil
+}
+
+// rollback cuts the log back to size, which it had before a failed append,
+// the sync of the next append makes it durable
+func (nf *FileEnvelopeStore) rollback(size int64) error {
+	if err := nf.mFile.Truncate(size); err != nil {
+		return err
+	}
+	_, err := nf.mFile.Seek(size, io.SeekStart)
+	return err
+}
+
+// Load returns the envelopes in the log
+func (nf *FileEnvelopeStore) Load() ([]types.SCPEnvelope, error) {
+	if nf.mFile == nil {
+		return nil, ErrEnvelopeStoreClosed
+	}
+	return append([]types.SCPEnvelope(nil), nf.mEnvelopes...), nil
+}
+
+// Truncate rewrites the log without the envelopes of the slots below
+// minSlotIndex. The new log replaces the old one atomically.
+func (nf *FileEnvelopeStore) Truncate(minSlotIndex uint64) error {
+	if nf.mFile == nil {
+		return ErrEnvelopeStoreClosed
+	}
+	var kept []types.SCPEnvelope
+	for _, e := range nf.mEnvelopes {
+		if e.Statement.SlotIndex >= minSlotIndex {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == len(nf.mEnvelopes) {
+		return nil
+	}
+
+	tmpPath := nf.mPath + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, e := range kept {
+		if _, err = w.Write(encodeEnvelopeRecord(e)); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		// the new log must be on disk before it replaces the old one
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, nf.mPath)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := syncDir(filepath.Dir(nf.mPath)); err != nil {
+		logWith(nf.mLogger, LogLevelError, "envelope store can't sync",
+			Field("path", nf.mPath), Field("error", err))
+	}
+
+	nf.mFile.Close()
+	if _, err := tmp.Seek(0, io.SeekEnd); err != nil {
+		tmp.Close()
+		nf.mFile = nil
+		return err
+	}
+	nf.mFile = tmp
+	nf.mEnvelopes = kept
+	// the new log holds no partial record
+	nf.mFailed = false
+	return nil
+}
+
+// Close closes the log file, the store can't be used afterwards
+func (nf *FileEnvelopeStore) Close() error {
+	if nf.mFile == nil {
+		return ErrEnvelopeStoreClosed
+	}
+	err := nf.mFile.Close()
+	nf.mFile = nil
+	return err
+}
+
+func (nf *FileEnvelopeStore) sync(f envelopeLogFile) error {
+	if nf.mPolicy == SyncNever {
+		return nil
+	}
+	return f.Sync()
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func encodeEnvelopeRecord(envelope types.SCPEnvelope) []byte {
+	payload := types.Pack(envelope)
+	record := make([]byte, envelopeRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, envelopeRecordTable))
+	copy(record[envelopeRecordHeaderSize:], payload)
+	return record
+}
+
+// readEnvelopeRecords reads the records of r from its start, it returns the
+// envelopes and the size of the valid prefix. Only the last record may be
+// torn (cut short, or with a bad checksum), reading stops there. Any other
+// damage is a *CorruptEnvelopeStoreError.
+func readEnvelopeRecords(r io.ReadSeeker, logger Logger) ([]types.SCPEnvelope, int64, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	br := bufio.NewReader(r)
+	var res []types.SCPEnvelope
+	var size int64
+	header := make([]byte, envelopeRecordHeaderSize)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				logWith(logger, LogLevelError, "envelope store torn record header", Field("offset", size))
+			} else if err != io.EOF {
+				return nil, 0, err
+			}
+			return res, size, nil
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > maxEnvelopeRecordSize {
+			return nil, 0, &CorruptEnvelopeStoreError{Offset: size, Reason: fmt.Sprintf("record length %d", length)}
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			if err != io.ErrUnexpectedEOF && err != io.EOF {
+				return nil, 0, err
+			}
+			logWith(logger, LogLevelError, "envelope store torn record", Field("offset", size))
+			return res, size, nil
+		}
+		if crc32.Checksum(payload, envelopeRecordTable) != binary.BigEndian.Uint32(header[4:8]) {
+			if _, err := br.Peek(1); err == nil {
+				return nil, 0, &CorruptEnvelopeStoreError{Offset: size, Reason: "bad checksum"}
+			} else if err != io.EOF {
+				return nil, 0, err
+			}
+			// the last record may not have reached the disk in full
+			logWith(logger, LogLevelError, "envelope store torn record", Field("offset", size))
+			return res, size, nil
+		}
+		var e types.SCPEnvelope
+		if err := types.Unpack(payload, &e); err != nil {
+			return nil, 0, &CorruptEnvelopeStoreError{Offset: size, Reason: err.Error()}
+		}
+		res = append(res, e)
+		size += int64(envelopeRecordHeaderSize) + int64(length)
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scp
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/scp/types"
+)
+
+func testEnvelope(slotIndex uint64, counter uint32) types.SCPEnvelope {
+	var e types.SCPEnvelope
+	e.Statement.NodeID = testNodeID(1)
+	e.Statement.SlotIndex = slotIndex
+	e.Statement.Type = types.SCPStPrepare
+	e.Statement.SCPStPrepare.Ballot = types.SCPBallot{Counter: counter, Value: "v"}
+	return e
+}
+
+// openTestStore opens the store at path, failing the test on error
+func openTestStore(t *testing.T, path string) *FileEnvelopeStore {
+	var store FileEnvelopeStore
+	if err := store.NFileEnvelopeStore(path, SyncAlways, nil); err != nil {
+		t.Fatal(err)
+	}
+	return &store
+}
+
+// writeTestStore creates a log at path holding envelopes
+func writeTestStore(t *testing.T, path string, envelopes ...types.SCPEnvelope) {
+	store := openTestStore(t, path)
+	for _, e := range envelopes {
+		if err := store.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkLoad fails the test if store doesn't hold want, in order
+func checkLoad(t *testing.T, store EnvelopeStore, want ...types.SCPEnvelope) {
+	t.Helper()
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d envelopes, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(types.Pack(got[i]), types.Pack(want[i])) {
+			t.Fatalf("envelope %d differs", i)
+		}
+	}
+}
+
+func TestFileEnvelopeStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "envelopes")
+	e1, e2, e3 := testEnvelope(1, 1), testEnvelope(1, 2), testEnvelope(2, 1)
+	writeTestStore(t, path, e1, e2)
+
+	store := openTestStore(t, path)
+	checkLoad(t, store, e1, e2)
+	// records go on after the reloaded ones
+	if err := store.Append(e3); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	if _, err := store.Load(); err != ErrEnvelopeStoreClosed {
+		t.Fatalf("got %v on a closed store", err)
+	}
+
+	store = openTestStore(t, path)
+	defer store.Close()
+	checkLoad(t, store, e1, e2, e3)
+}
+
+func TestFileEnvelopeStoreTornTail(t *testing.T) {
+	e1, e2, e3 := testEnvelope(1, 1), testEnvelope(1, 2), testEnvelope(2, 1)
+	record := encodeEnvelopeRecord(e3)
+	badChecksum := append([]byte(nil), record...)
+	badChecksum[len(badChecksum)-1] ^= 0xff
+
+	for name, tail := range map[string][]byte{
+		"header":   record[:envelopeRecordHeaderSize-3],
+		"payload":  record[:len(record)-1],
+		"checksum": badChecksum,
+	} {
+		path := filepath.Join(t.TempDir(), "envelopes")
+		writeTestStore(t, path, e1, e2)
+		size := fileSize(t, path)
+		appendToFile(t, path, tail)
+
+		store := openTestStore(t, path)
+		checkLoad(t, store, e1, e2)
+		if got := fileSize(t, path); got != size {
+			t.Fatalf("%s: torn record kept, size %d, want %d", name, got, size)
+		}
+		if err := store.Append(e3); err != nil {
+			t.Fatal(err)
+		}
+		store.Close()
+
+		store = openTestStore(t, path)
+		checkLoad(t, store, e1, e2, e3)
+		store.Close()
+	}
+}
+
+func TestFileEnvelopeStoreCorruptRecord(t *testing.T) {
+	e1, e2, e3 := testEnvelope(1, 1), testEnvelope(1, 2), testEnvelope(2, 1)
+	second := int64(len(encodeEnvelopeRecord(e1)))
+
+	for name, corrupt := range map[string]func(b []byte){
+		// a payload byte of the second record
+		"checksum": func(b []byte) { b[second+envelopeRecordHeaderSize] ^= 0xff },
+		// the length of the second record
+		"length": func(b []byte) { b[second] = 0xff },
+	} {
+		path := filepath.Join(t.TempDir(), "envelopes")
+		writeTestStore(t, path, e1, e2, e3)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corrupt(b)
+		if err := os.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		var store FileEnvelopeStore
+		err = store.NFileEnvelopeStore(path, SyncAlways, nil)
+		ce, ok := err.(*CorruptEnvelopeStoreError)
+		if !ok || ce.Offset != second {
+			t.Fatalf("%s: got %v, want corruption at %d", name, err, second)
+		}
+		// nothing is dropped from a log that can't be trusted
+		if got := fileSize(t, path); got != int64(len(b)) {
+			t.Fatalf("%s: log truncated to %d", name, got)
+		}
+	}
+}
+
+func TestFileEnvelopeStoreTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "envelopes")
+	e1, e2, e3, e4 := testEnvelope(1, 1), testEnvelope(2, 1), testEnvelope(3, 1), testEnvelope(3, 2)
+	writeTestStore(t, path, e1, e2, e3, e4)
+
+	store := openTestStore(t, path)
+	if err := store.Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	checkLoad(t, store, e3, e4)
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left: %v", err)
+	}
+	// the rewritten log takes new records
+	e5 := testEnvelope(4, 1)
+	if err := store.Append(e5); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store = openTestStore(t, path)
+	defer store.Close()
+	checkLoad(t, store, e3, e4, e5)
+}
+
+// faultyLogFile fails the writes past writeLimit bytes, and the calls
+// whose error is set
+type faultyLogFile struct {
+	envelopeLogFile
+	writeLimit  int
+	syncErr     error
+	truncateErr error
+}
+
+var errTestDiskFull = errors.New("disk full")
+
+func (f *faultyLogFile) Write(b []byte) (int, error) {
+	if len(b) <= f.writeLimit {
+		return f.envelopeLogFile.Write(b)
+	}
+	n, err := f.envelopeLogFile.Write(b[:f.writeLimit])
+	if err == nil {
+		err = errTestDiskFull
+	}
+	return n, err
+}
+
+func (f *faultyLogFile) Sync() error {
+	if f.syncErr != nil {
+		return f.syncErr
+	}
+	return f.envelopeLogFile.Sync()
+}
+
+func (f *faultyLogFile) Truncate(size int64) error {
+	if f.truncateErr != nil {
+		return f.truncateErr
+	}
+	return f.envelopeLogFile.Truncate(size)
+}
+
+func TestFileEnvelopeStoreFailedAppend(t *testing.T) {
+	e1, e2, e3 := testEnvelope(1, 1), testEnvelope(1, 2), testEnvelope(2, 1)
+	recordSize := len(encodeEnvelopeRecord(e2))
+
+	for name, faulty := range map[string]*faultyLogFile{
+		"short write": {writeLimit: recordSize / 2},
+		"sync":        {writeLimit: recordSize, syncErr: errTestDiskFull},
+	} {
+		path := filepath.Join(t.TempDir(), "envelopes")
+		store := openTestStore(t, path)
+		if err := store.Append(e1); err != nil {
+			t.Fatal(err)
+		}
+		faulty.envelopeLogFile = store.mFile
+		store.mFile = faulty
+		if err := store.Append(e2); err != errTestDiskFull {
+			t.Fatalf("%s: got %v, want %v", name, err, errTestDiskFull)
+		}
+		// the disk has room again
+		store.mFile = faulty.envelopeLogFile
+		if err := store.Append(e3); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		checkLoad(t, store, e1, e3)
+		store.Close()
+
+		store = openTestStore(t, path)
+		checkLoad(t, store, e1, e3)
+		store.Close()
+	}
+}
+
+func TestFileEnvelopeStoreFailedRollback(t *testing.T) {
+	e1, e2 := testEnvelope(1, 1), testEnvelope(2, 1)
+	path := filepath.Join(t.TempDir(), "envelopes")
+	store := openTestStore(t, path)
+	defer store.Close()
+	faulty := &faultyLogFile{envelopeLogFile: store.mFile, writeLimit: 3, truncateErr: errTestDiskFull}
+	store.mFile = faulty
+	if err := store.Append(e1); err != errTestDiskFull {
+		t.Fatalf("got %v, want %v", err, errTestDiskFull)
+	}
+	// the partial record is still there, nothing may follow it
+	store.mFile = faulty.envelopeLogFile
+	if err := store.Append(e2); err != ErrEnvelopeStoreFailed {
+		t.Fatalf("got %v, want %v", err, ErrEnvelopeStoreFailed)
+	}
+	checkLoad(t, store)
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func appendToFile(t *testing.T, path string, b []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
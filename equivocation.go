@@ -0,0 +1,175 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scp
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/scp/types"
+)
+
+//enum
+type EquivocationKind int32
+
+const (
+	// the node accepted (CONFIRM) or externalized commits for two different
+	// values
+	EquivocationConflictingCommit EquivocationKind = iota
+	// the node sent two nominations, neither containing the other
+	EquivocationNonMonotonicNomination
+)
+
+var equivocationKindMap = map[int32]string{
+	0: "EquivocationConflictingCommit",
+	1: "EquivocationNonMonotonicNomination",
+}
+
+// ValidEnum validates a proposed value for this enum.  Implements
+// the Enum interface for EquivocationKind
+func (e EquivocationKind) ValidEnum(v int32) bool {
+	_, ok := equivocationKindMap[v]
+	return ok
+}
+
+// String returns the name of `e`
+func (e EquivocationKind) String() string {
+	name, _ := equivocationKindMap[int32(e)]
+	return name
+}
+
+// Equivocation is the proof that a node contradicted itself on a slot: both
+// signed envelopes are kept so that other nodes can check it with
+// verifyEquivocation.
+type Equivocation struct {
+	Kind   EquivocationKind
+	First  types.SCPEnvelope // the envelope received first
+	Second types.SCPEnvelope
+}
+
+func (e *Equivocation) String() string {
+	return fmt.Sprintf("%s by %s on slot %d", e.Kind,
+		toShortString(e.First.Statement.NodeID), e.First.Statement.SlotIndex)
+}
+
+// IsEquivocation tells if the statements st1 and st2 contradict each other,
+// kind is set to how they do
+func IsEquivocation(st1 types.SCPStatement, st2 types.SCPStatement, kind *EquivocationKind) bool {
+	if CompareNodeID(st1.NodeID, st2.NodeID) != 0 || st1.SlotIndex != st2.SlotIndex {
+		return false
+	}
+
+	nominate1 := st1.Type == types.SCPStNominate
+	nominate2 := st2.Type == types.SCPStNominate
+	switch {
+	case nominate1 && nominate2:
+		// nominations only grow, each node sends a chain of them
+		if IsNewerStatement(st1, st2) || IsNewerStatement(st2, st1) ||
+			isSameNomination(st1.SCPStNominate, st2.SCPStNominate) {
+			return false
+		}
+		*kind = EquivocationNonMonotonicNomination
+		return true
+	case !nominate1 && !nominate2:
+		// a node that accepted commit is locked on its value
+		v1, committed1 := getAcceptedCommitValue(st1)
+		v2, committed2 := getAcceptedCommitValue(st2)
+		if !committed1 || !committed2 || compareValues(v1, v2) == 0 {
+			return false
+		}
+		*kind = EquivocationConflictingCommit
+		return true
+	}
+	return false
+}
+
+func isSameNomination(nom1 types.SCPNomination, nom2 types.SCPNomination) bool {
+	var notEqual bool
+	return isSubsetHelper(nom1.Votes, nom2.Votes, &notEqual) && !notEqual &&
+		isSubsetHelper(nom1.Accepted, nom2.Accepted, &notEqual) && !notEqual
+}
+
+// getAcceptedCommitValue returns the value st accepted a commit for, false
+// if it accepted none
+func getAcceptedCommitValue(st types.SCPStatement) (interface{}, bool) {
+	switch st.Type {
+	case types.SCPStConfirm:
+		return st.SCPStConfirm.Ballot.Value, true
+	case types.SCPStExternalize:
+		return st.SCPStExternalize.Commit.Value, true
+	}
+	return nil, false
+}
+
+// checkEquivocation compares envelope to the latest statement of the same
+// kind received from its node. On a contradiction the evidence is kept,
+// reported to the driver and returned.
+func (ns *Slot) checkEquivocation(envelope types.SCPEnvelope) *Equivocation {
+	st := envelope.Statement
+	latest := ns.mLatestEnvelopes
+	if st.Type == types.SCPStNominate {
+		latest = ns.mLatestNominations
+	}
+	old, exist := latest[keyOf(st.NodeID)]
+	if !exist {
+		return nil
+	}
+	var kind EquivocationKind
+	if !IsEquivocation(old.Statement, st, &kind) {
+		return nil
+	}
+
+	ev := Equivocation{Kind: kind, First: old, Second: envelope}
+	if _, reported := ns.mEquivocations[keyOf(st.NodeID)]; !reported {
+		// the first proof is enough, the node is reported once per slot
+		ns.mEquivocations[keyOf(st.NodeID)] = ev
+		ns.mSCP.mDriver.equivocationDetected(ev)
+	}
+	return &ev
+}
+
+// getEquivocations returns the evidence collected for this slot, one per
+// node that equivocated
+func (ns *Slot) getEquivocations() []Equivocation {
+	res := make([]Equivocation, 0, len(ns.mEquivocations))
+	for _, ev := range ns.mEquivocations {
+		res = append(res, ev)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return CompareNodeID(res[i].First.Statement.NodeID, res[j].First.Statement.NodeID) < 0
+	})
+	return res
+}
+
+// verifyEquivocation checks evidence received from a third party: both
+// envelopes must be properly signed and contradict each other. Signatures
+// can't be checked without the VerifyEnvelope hook of the driver, no
+// evidence is accepted then.
+func (ns *SCP) verifyEquivocation(evidence Equivocation) bool {
+	if ns.mDriver.VerifyEnvelope == nil {
+		return false
+	}
+	var kind EquivocationKind
+	return ns.mDriver.verifyEnvelope(evidence.First) &&
+		ns.mDriver.verifyEnvelope(evidence.Second) &&
+		IsEquivocation(evidence.First.Statement, evidence.Second.Statement, &kind) &&
+		kind == evidence.Kind
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scp
+
+import (
+	"github.com/scp/types"
+)
+
+// LivenessReport tells if the local node can make progress with the nodes
+// that currently respond.
+//  * Quorum is the largest quorum of responsive nodes containing the local
+//    node, empty if there is none
+//  * MissingNodes are the non responsive nodes transitively reachable from
+//    the local quorum set
+//  * NodesToRestore is the smallest set of missing nodes that must come back
+//    for the local quorum set to be satisfied again
+type LivenessReport struct {
+	QuorumReachable bool           `json:"quorumReachable"`
+	Quorum          []types.NodeID `json:"quorum"`
+	MissingNodes    []types.NodeID `json:"missingNodes"`
+	NodesToRestore  []types.NodeID `json:"nodesToRestore"`
+}
+
+// Liveness computes the LivenessReport of the local node, responsive maps
+// the nodes that currently respond to their quorum set.
+func (nl *LocalNode) Liveness(responsive map[types.NodeID]types.SCPQuorumSet) LivenessReport {
+	qMap := make(map[types.NodeID]types.SCPQuorumSet)
+	for n, q := range responsive {
+		if CompareNodeID(n, nl.mNodeID) != 0 {
+			qMap[n] = q
+		}
+	}
+	localQSet := nl.QuorumSet()
+	qMap[nl.mNodeID] = localQSet
+
+	g := newQuorumGraph(qMap)
+	local := g.index(nl.mNodeID)
+
+	res := LivenessReport{}
+	quorum := g.contractToMaximalQuorum(g.known())
+	if quorum.has(local) {
+		res.QuorumReachable = true
+		res.Quorum = g.nodesOf(quorum)
+	}
+
+	// perform a transitive search, starting with the local node, the
+	// quorum sets of the missing nodes are unknown so the search stops there
+	visited := g.newSet()
+	missing := g.newSet()
+	backlog := []int{local}
+	visited.set(local)
+	for len(backlog) != 0 {
+		i := backlog[len(backlog)-1]
+		backlog = backlog[:len(backlog)-1]
+
+		if g.qSets[i] == nil {
+			missing.set(i)
+			continue
+		}
+		forAllIndexedNodes(g.qSets[i], func(n int) {
+			if !visited.has(n) {
+				visited.set(n)
+				backlog = append(backlog, n)
+			}
+		})
+	}
+	res.MissingNodes = g.nodesOf(missing)
+
+	// a set contains a slice of qSet if and only if it is v-blocking for
+	// the dual of qSet, so the closest v-blocking set of the dual among the
+	// missing nodes is the smallest set that completes a slice
+	down := make(map[nodeKey]struct{})
+	ForAllNodes(localQSet, func(n types.NodeID) {
+		if g.qSets[g.index(n)] == nil {
+			down[keyOf(n)] = struct{}{}
+		}
+	})
+	res.NodesToRestore = findClosestVBlockingF(dualQSet(localQSet), down, nil)
+
+	return res
+}
+
+// called recursively
+func forAllIndexedNodes(qSet *indexedQSet, proc func(n int)) {
+	for _, n := range qSet.validators {
+		proc(n)
+	}
+	for i := range qSet.innerSets {
+		forAllIndexedNodes(&qSet.innerSets[i], proc)
+	}
+}
+
+// dualQSet returns the quorum set whose slices are the v-blocking sets of
+// qSet (and the other way around): the threshold t of each set of n
+// entries becomes n - t + 1
+func dualQSet(qSet types.SCPQuorumSet) types.SCPQuorumSet {
+	res := types.SCPQuorumSet{Validators: qSet.Validators}
+	for _, inner := range qSet.InnerSets {
+		res.InnerSets = append(res.InnerSets, dualQSet(inner))
+	}
+	total := uint32(len(qSet.Validators) + len(qSet.InnerSets))
+	if qSet.Threshold <= total {
+		res.Threshold = total - qSet.Threshold + 1
+	}
+	return res
+}
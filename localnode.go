@@ -25,19 +25,23 @@ package scp
 import (
 	"crypto/sha256"
 	"encoding/json"
-	"log"
+	"errors"
 	"math"
-	"math/big"
+	"math/bits"
 	"sort"
 
 	"github.com/scp/types"
 )
 
 type LocalNode struct {
-	mNodeID      types.NodeID
+	mNodeID types.NodeID
+	// a node that is not a validator is a watcher: it follows the slots
+	// but never emits statements
 	mIsValidator bool
-	mQSet        types.SCPQuorumSet
-	mQSetHash    types.Hash
+
+	// quorum set changes, sorted by slot index, the first one is from
+	// slot 0
+	mQSetChanges []qSetChange
 
 	// alternative qSet used during externalize {{mNodeID}}
 	gSingleQSetHash types.Hash          // hash of the singleton qSet
@@ -46,24 +50,37 @@ type LocalNode struct {
 	mSCP *SCP
 }
 
+// qSetChange is a quorum set used from slot fromSlot on
+type qSetChange struct {
+	fromSlot uint64
+	qSet     types.SCPQuorumSet
+	qSetHash types.Hash
+}
+
 func (nl *LocalNode) NLocalNode(nodeID types.NodeID, isValidator bool,
 	qSet types.SCPQuorumSet, scp *SCP) {
 	nl.mNodeID = nodeID
 	nl.mIsValidator = isValidator
-	nl.mQSet = qSet
 	nl.mSCP = scp
 
-	NormalizeQSet(&nl.mQSet)
-	nl.mQSetHash = sha256.Sum256(types.Pack(nl.mQSet))
+	qSet = NormalizeQSet(qSet, nil)
+	qSetHash := sha256.Sum256(types.Pack(qSet))
+	nl.mQSetChanges = []qSetChange{{0, qSet, qSetHash}}
 
-	//StringAbbrev, HexAbbrev
-	// TODO encode mQSetHash?
-	log.Printf("INFO SCP: LocalNode@%.6s qSet: %.3X", nl.mNodeID, nl.mQSetHash)
+	nl.log(LogLevelInfo, "LocalNode created",
+		Field("node", toShortString(nl.mNodeID)), Field("qSet", hexAbbrev(qSetHash)))
 
 	nl.mSingleQSet = buildSingletonQSet(nl.mNodeID)
 	nl.gSingleQSetHash = sha256.Sum256(types.Pack(nl.mSingleQSet))
 }
 
+// log sends a record to the logger of the driver, if any
+func (nl *LocalNode) log(level LogLevel, msg string, fields ...LogField) {
+	if nl.mSCP != nil {
+		nl.mSCP.mDriver.log(level, msg, fields...)
+	}
+}
+
 // buildSingletonQSet returns a quorum set {{ nodeID }}
 func buildSingletonQSet(nodeID types.NodeID) *types.SCPQuorumSet {
 	return &types.SCPQuorumSet{
@@ -71,17 +88,88 @@ func buildSingletonQSet(nodeID types.NodeID) *types.SCPQuorumSet {
 		Validators: []types.NodeID{nodeID}}
 }
 
-func (nl *LocalNode) UpdateQuorumSet(qSet types.SCPQuorumSet) {
-	nl.mQSetHash = sha256.Sum256(types.Pack(qSet))
-	nl.mQSet = qSet
+// ErrInsaneQuorumSet is returned when a quorum set fails the sanity checks
+var ErrInsaneQuorumSet = errors.New("SCP: quorum set is not sane")
+
+// ErrQuorumSetChangeTooLate is returned when a quorum set change would
+// apply to slots already running
+var ErrQuorumSetChangeTooLate = errors.New("SCP: quorum set change for a running slot")
+
+// UpdateQuorumSet checks qSet and uses its normalized form from slot
+// fromSlot on, the slots below keep their quorum set. fromSlot must be
+// above the slots SCP already runs. Changes previously scheduled from
+// fromSlot on are dropped.
+func (nl *LocalNode) UpdateQuorumSet(qSet types.SCPQuorumSet, fromSlot uint64) error {
+	if !IsQuorumSetSane(qSet, false) {
+		return ErrInsaneQuorumSet
+	}
+	if nl.mSCP != nil && !nl.mSCP.empty() && fromSlot <= nl.mSCP.getHighSlotIndex() {
+		return ErrQuorumSetChangeTooLate
+	}
+	qSet = NormalizeQSet(qSet, nil)
+	qSetHash := sha256.Sum256(types.Pack(qSet))
+
+	i := sort.Search(len(nl.mQSetChanges), func(i int) bool {
+		return nl.mQSetChanges[i].fromSlot >= fromSlot
+	})
+	nl.mQSetChanges = append(nl.mQSetChanges[:i], qSetChange{fromSlot, qSet, qSetHash})
+
+	nl.log(LogLevelInfo, "LocalNode UpdateQuorumSet",
+		Field("slot", fromSlot), Field("qSet", hexAbbrev(qSetHash)))
+	return nil
 }
 
+// QuorumSet returns the quorum set of the local node for the highest slot
+// running, changes scheduled for later slots are not in effect yet
 func (nl *LocalNode) QuorumSet() types.SCPQuorumSet {
-	return nl.mQSet
+	qSet, _ := nl.QuorumSetForSlot(nl.currentSlot())
+	return qSet
 }
 
+// QuorumSetHash returns the hash of QuorumSet
 func (nl *LocalNode) QuorumSetHash() types.Hash {
-	return nl.mQSetHash
+	_, qSetHash := nl.QuorumSetForSlot(nl.currentSlot())
+	return qSetHash
+}
+
+// currentSlot returns the highest slot SCP runs, 0 if none
+func (nl *LocalNode) currentSlot() uint64 {
+	if nl.mSCP == nil {
+		return 0
+	}
+	return nl.mSCP.getHighSlotIndex()
+}
+
+// QuorumSetForSlot returns the quorum set (and its hash) the local node
+// uses for slotIndex
+func (nl *LocalNode) QuorumSetForSlot(slotIndex uint64) (types.SCPQuorumSet, types.Hash) {
+	i := sort.Search(len(nl.mQSetChanges), func(i int) bool {
+		return nl.mQSetChanges[i].fromSlot > slotIndex
+	})
+	// the first change is always from slot 0
+	c := nl.mQSetChanges[i-1]
+	return c.qSet, c.qSetHash
+}
+
+// usesQuorumSet tells if a quorum set change holds the set for qSetHash
+func (nl *LocalNode) usesQuorumSet(qSetHash types.Hash) bool {
+	for _, c := range nl.mQSetChanges {
+		if c.qSetHash == qSetHash {
+			return true
+		}
+	}
+	return false
+}
+
+// purgeQuorumSets forgets the quorum sets only used by the slots below
+// maxSlotIndex, the set used by maxSlotIndex then applies from slot 0
+func (nl *LocalNode) purgeQuorumSets(maxSlotIndex uint64) {
+	i := sort.Search(len(nl.mQSetChanges), func(i int) bool {
+		return nl.mQSetChanges[i].fromSlot > maxSlotIndex
+	})
+	changes := append([]qSetChange{}, nl.mQSetChanges[i-1:]...)
+	changes[0].fromSlot = 0
+	nl.mQSetChanges = changes
 }
 
 // SingletonQSet returns the quorum set {{X}}
@@ -100,13 +188,13 @@ func forAllNodesInternal(qSet types.SCPQuorumSet, proc func(nodeID types.NodeID)
 	}
 }
 
-// ForAllNodes runs proc over all nodes contained in qSet
+// ForAllNodes runs proc over all nodes contained in qSet, once per node
 func ForAllNodes(qSet types.SCPQuorumSet, proc func(nodeID types.NodeID)) {
-	done := make(map[types.NodeID]struct{})
+	done := make(map[nodeKey]struct{})
 	forAllNodesInternal(qSet, func(n types.NodeID) {
-		if _, exist := done[n]; !exist {
+		if _, exist := done[keyOf(n)]; !exist {
 			// n was not present
-			done[n] = struct{}{}
+			done[keyOf(n)] = struct{}{}
 			proc(n)
 		}
 	})
@@ -117,28 +205,64 @@ func ForAllNodes(qSet types.SCPQuorumSet, proc func(nodeID types.NodeID)) {
 // *if a validator is repeated multiple times its weight is only the
 // weight of the first occurrence
 func GetNodeWeight(nodeID types.NodeID, qSet types.SCPQuorumSet) uint64 {
+	return ComputeNodeWeight(nodeID, qSet, false)
+}
+
+// ComputeNodeWeight returns the weight of the node within the qSet
+// normalized between 0-UINT64_MAX
+// if aggregate is set, the weights of all the occurrences of a repeated
+// validator are added up (capped at UINT64_MAX), otherwise only the first
+// occurrence counts as in GetNodeWeight
+func ComputeNodeWeight(nodeID types.NodeID, qSet types.SCPQuorumSet, aggregate bool) uint64 {
 	n := uint64(qSet.Threshold)
 	d := uint64(len(qSet.InnerSets) + len(qSet.Validators))
 
+	var res uint64
 	for _, qSetNode := range qSet.Validators {
-		if qSetNode == nodeID {
-			return bigDivideReturn(math.MaxUint64, n, d, types.RoundDown)
+		if CompareNodeID(qSetNode, nodeID) == 0 {
+			w := weightShare(math.MaxUint64, n, d)
+			if !aggregate {
+				return w
+			}
+			res = saturatingAdd(res, w)
 		}
 	}
 	for _, q := range qSet.InnerSets {
-		leafW := GetNodeWeight(nodeID, q)
+		leafW := ComputeNodeWeight(nodeID, q, aggregate)
 		if leafW != 0 {
-			return bigDivideReturn(leafW, n, d, types.RoundDown)
+			w := weightShare(leafW, n, d)
+			if !aggregate {
+				return w
+			}
+			res = saturatingAdd(res, w)
 		}
 	}
 
-	return 0
+	return res
+}
+
+// weightShare returns w*n/d rounded down, capped at UINT64_MAX
+// (a threshold above the number of entries would overflow)
+func weightShare(w uint64, n uint64, d uint64) uint64 {
+	res, ok := bigDivide(w, n, d, types.RoundDown)
+	if !ok {
+		return math.MaxUint64
+	}
+	return res
+}
+
+func saturatingAdd(a uint64, b uint64) uint64 {
+	sum, carry := bits.Add64(a, b, 0)
+	if carry != 0 {
+		return math.MaxUint64
+	}
+	return sum
 }
 
 func isQuorumSliceInternal(qSet types.SCPQuorumSet, nodeSet []types.NodeID) bool {
 	thresholdLeft := qSet.Threshold
 	for _, validator := range qSet.Validators {
-		index := SliceIndex(len(qSet.Validators), func(i int) bool { return validator == nodeSet[i] })
+		index := SliceIndex(len(nodeSet), func(i int) bool { return CompareNodeID(validator, nodeSet[i]) == 0 })
 		if index != -1 {
 			//found
 			thresholdLeft--
@@ -160,9 +284,6 @@ func isQuorumSliceInternal(qSet types.SCPQuorumSet, nodeSet []types.NodeID) bool
 
 // IsQuorumSlice tests this node against nodeSet for the specified qSethash.
 func IsQuorumSlice(qSet types.SCPQuorumSet, nodeSet []types.NodeID) bool {
-
-	log.Printf("TRACE SCP: LocalNode IsQuorumSlice len(nodeSet): %v", len(nodeSet))
-
 	return isQuorumSliceInternal(qSet, nodeSet)
 }
 
@@ -175,7 +296,7 @@ func isVBlockingInternal(qSet types.SCPQuorumSet, nodeSet []types.NodeID) bool {
 
 	leftTillBlock := (1 + len(qSet.Validators) + len(qSet.InnerSets)) - int(qSet.Threshold)
 	for _, validator := range qSet.Validators {
-		index := SliceIndex(len(qSet.Validators), func(i int) bool { return validator == nodeSet[i] })
+		index := SliceIndex(len(nodeSet), func(i int) bool { return CompareNodeID(validator, nodeSet[i]) == 0 })
 		if index != -1 {
 			//found
 			leftTillBlock--
@@ -197,9 +318,6 @@ func isVBlockingInternal(qSet types.SCPQuorumSet, nodeSet []types.NodeID) bool {
 
 // IsVBlocking tests this node against a map of nodeID -> T for the specified qSetHash.
 func IsVBlocking(qSet types.SCPQuorumSet, nodeSet []types.NodeID) bool {
-
-	log.Printf("TRACE SCP: LocalNode IsVBlocking len(nodeSet): %v", len(nodeSet))
-
 	return isVBlockingInternal(qSet, nodeSet)
 }
 
@@ -265,37 +383,84 @@ func IsQuorum(qSet types.SCPQuorumSet, map1 map[types.NodeID]types.SCPEnvelope,
 // FindClosestVBlocking computes the distance to the set of v-blocking sets given
 // a set of nodes that agree (but can fail)
 // excluded, if set will be skipped altogether
+// The result is a set of minimal size among the filtered nodes that, added
+// to the nodes that don't agree, forms a v-blocking set. It is empty if the
+// nodes that don't agree are already v-blocking, and holds all the nodes
+// that can help if no v-blocking set can be reached. Nodes are sorted with
+// CompareNodeID.
+// If a node appears more than once in qSet, finding the minimal set takes a
+// search that is given up after maxClosestVBlockingSubsets tries: the
+// result is then v-blocking but may not be minimal.
 func FindClosestVBlocking(qSet types.SCPQuorumSet, map1 map[types.NodeID]types.SCPEnvelope,
 	filter func(types.SCPStatement) bool, excluded *types.NodeID) []types.NodeID {
 
-	s := make(map[types.NodeID]struct{})
+	s := make(map[nodeKey]struct{})
 
 	for k, v := range map1 {
 		if filter(v.Statement) {
-			s[k] = struct{}{}
+			s[keyOf(k)] = struct{}{}
 		}
 	}
 	return findClosestVBlockingF(qSet, s, excluded)
 }
 
+// most sets findClosestVBlockingExhaustive tries before giving up
+const maxClosestVBlockingSubsets = 1 << 16
+
 //filtered
-func findClosestVBlockingF(qSet types.SCPQuorumSet, nodes map[types.NodeID]struct{},
+func findClosestVBlockingF(qSet types.SCPQuorumSet, nodes map[nodeKey]struct{},
 	excluded *types.NodeID) []types.NodeID {
 
-	leftTillBlock := (1 + len(qSet.Validators) + len(qSet.InnerSets)) - int(qSet.Threshold)
+	res, blocked := findClosestVBlockingInternal(qSet, nodes, excluded)
+	if blocked && hasRepeatedNodes(qSet) {
+		// the entries of qSet share nodes, so picking the closest entries
+		// one by one only gives an upper bound, kept if the search is too
+		// long
+		exact := findClosestVBlockingExhaustive(qSet, nodes, excluded, len(res),
+			maxClosestVBlockingSubsets)
+		if exact != nil {
+			res = exact
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return CompareNodeID(res[i], res[j]) < 0 })
+	// a node repeated in qSet may have been picked twice
+	sorted := []types.NodeID{}
+	for _, n := range res {
+		if len(sorted) == 0 || CompareNodeID(sorted[len(sorted)-1], n) != 0 {
+			sorted = append(sorted, n)
+		}
+	}
+	return sorted
+}
 
-	var res []types.NodeID
+// called recursively, blocked is false if no v-blocking set can be reached,
+// res then holds all the nodes that get closer
+// the result is minimal if no node appears twice in qSet
+func findClosestVBlockingInternal(qSet types.SCPQuorumSet, nodes map[nodeKey]struct{},
+	excluded *types.NodeID) (res []types.NodeID, blocked bool) {
+
+	// There is no v-blocking set for {\empty}
+	if qSet.Threshold == 0 {
+		return nil, false
+	}
+
+	leftTillBlock := (1 + len(qSet.Validators) + len(qSet.InnerSets)) - int(qSet.Threshold)
+	if leftTillBlock < 1 {
+		// there is no slice, but as in isVBlockingInternal one entry
+		// still needs to be blocked
+		leftTillBlock = 1
+	}
 
 	// first, compute how many top level items need to be blocked
 	for _, validator := range qSet.Validators {
-		if excluded == nil || !(validator == *excluded) {
+		if excluded == nil || CompareNodeID(validator, *excluded) != 0 {
 
-			if _, exist := nodes[validator]; !exist {
+			if _, exist := nodes[keyOf(validator)]; !exist {
 				// n was not present
 				leftTillBlock--
 				if leftTillBlock == 0 {
 					// already blocked
-					return []types.NodeID{}
+					return []types.NodeID{}, true
 				}
 			} else {
 				// save this for later
@@ -304,16 +469,19 @@ func findClosestVBlockingF(qSet types.SCPQuorumSet, nodes map[types.NodeID]struc
 		}
 	}
 
-	//SliceStable(slice interface{}, less func(i, j int) bool)
 	var resInternals [][]types.NodeID
 
 	for _, inner := range qSet.InnerSets {
-		v := findClosestVBlockingF(inner, nodes, excluded)
+		v, innerBlocked := findClosestVBlockingInternal(inner, nodes, excluded)
+		if !innerBlocked {
+			// this inner set can't help
+			continue
+		}
 		if len(v) == 0 {
 			leftTillBlock--
 			if leftTillBlock == 0 {
 				// already blocked
-				return []types.NodeID{}
+				return []types.NodeID{}, true
 			}
 		} else {
 			resInternals = append(resInternals, v)
@@ -322,9 +490,10 @@ func findClosestVBlockingF(qSet types.SCPQuorumSet, nodes map[types.NodeID]struc
 	//sort by length (stable) after all are inserted
 	sort.SliceStable(resInternals, func(i, j int) bool { return len(resInternals[i]) < len(resInternals[j]) })
 
-	//use the top level validators to get closer
+	//use the top level validators to get closer, they cost one node each
+	//which is never more than an inner set
 	if len(res) > leftTillBlock {
-		res = res[:leftTillBlock-1]
+		res = res[:leftTillBlock]
 	}
 	leftTillBlock -= len(res)
 
@@ -334,7 +503,65 @@ func findClosestVBlockingF(qSet types.SCPQuorumSet, nodes map[types.NodeID]struc
 		leftTillBlock--
 	}
 
-	return res
+	return res, leftTillBlock == 0
+}
+
+// findClosestVBlockingExhaustive tries the sets of at most maxSize agreeing
+// nodes, smallest first, and returns the first v-blocking one. It returns
+// nil if there is none or if it tried maxSubsets sets without success.
+func findClosestVBlockingExhaustive(qSet types.SCPQuorumSet, nodes map[nodeKey]struct{},
+	excluded *types.NodeID, maxSize int, maxSubsets int) []types.NodeID {
+
+	var failed []types.NodeID
+	var candidates []types.NodeID
+	ForAllNodes(qSet, func(n types.NodeID) {
+		if excluded != nil && CompareNodeID(n, *excluded) == 0 {
+			return
+		}
+		if _, exist := nodes[keyOf(n)]; exist {
+			candidates = append(candidates, n)
+		} else {
+			failed = append(failed, n)
+		}
+	})
+	sort.Slice(candidates, func(i, j int) bool { return CompareNodeID(candidates[i], candidates[j]) < 0 })
+
+	tried := 0
+	for size := 0; size <= maxSize && size <= len(candidates); size++ {
+		var res []types.NodeID
+		forEachSubset(len(candidates), size, func(subset []int) bool {
+			if tried == maxSubsets {
+				return false
+			}
+			tried++
+			nodeSet := append([]types.NodeID{}, failed...)
+			for _, i := range subset {
+				nodeSet = append(nodeSet, candidates[i])
+			}
+			if isVBlockingInternal(qSet, nodeSet) {
+				res = nodeSet[len(failed):]
+				return false
+			}
+			return true
+		})
+		if res != nil || tried == maxSubsets {
+			return res
+		}
+	}
+	return nil
+}
+
+// hasRepeatedNodes tells if a node appears more than once in qSet
+func hasRepeatedNodes(qSet types.SCPQuorumSet) bool {
+	seen := make(map[nodeKey]struct{})
+	repeated := false
+	forAllNodesInternal(qSet, func(n types.NodeID) {
+		if _, exist := seen[keyOf(n)]; exist {
+			repeated = true
+		}
+		seen[keyOf(n)] = struct{}{}
+	})
+	return repeated
 }
 
 func (nl *LocalNode) ToJson(qSet types.SCPQuorumSet, value *types.Json) {
@@ -355,7 +582,7 @@ func (nl *LocalNode) ToString(qSet types.SCPQuorumSet) string {
 	nl.ToJson(qSet, &v)
 	fw, err := json.Marshal(v)
 	if err != nil {
-		log.Printf("ERROR SCP: LocalNode ToString: %s", err)
+		nl.log(LogLevelError, "LocalNode ToString", Field("error", err))
 	}
 	return string(fw)
 }
@@ -426,43 +653,29 @@ func SliceIndex(limit int, predicate func(i int) bool) int {
 }
 
 //util
-func bigDivideReturn(A uint64, B uint64, C uint64, rounding types.Rounding) uint64 {
-
-	a := new(big.Int).SetUint64(A)
-	b := new(big.Int).SetUint64(B)
-	c := new(big.Int).SetUint64(C)
-	x := big.NewInt(0)
-	if rounding == types.RoundDown {
-		x.Mul(a, b)
-		x.Div(x, c)
-	} else {
-		x.Mul(a, b)
-		x.Add(x, new(big.Int).Sub(c, big.NewInt(1))).Div(x, c)
+// bigDivide computes A*B/C with a 128 bits intermediate product, rounded
+// as requested. It returns false if C is 0 or if the result doesn't fit
+// in 64 bits.
+func bigDivide(A uint64, B uint64, C uint64, rounding types.Rounding) (uint64, bool) {
+	if C == 0 {
+		return 0, false
 	}
 
-	return x.Uint64()
-}
-
-//util
-func bigDivide(result uint64, A uint64, B uint64, C uint64, rounding types.Rounding) bool {
-
-	a := new(big.Int).SetUint64(A)
-	b := new(big.Int).SetUint64(B)
-	c := new(big.Int).SetUint64(C)
-	x := big.NewInt(0)
-	if rounding == types.RoundDown {
-		x.Mul(a, b)
-		x.Div(x, c)
-	} else {
-		x.Mul(a, b)
-		x.Add(x, new(big.Int).Sub(c, big.NewInt(1))).Div(x, c)
+	hi, lo := bits.Mul64(A, B)
+	if rounding == types.RoundUp {
+		// (A*B + C - 1) / C
+		var carry uint64
+		lo, carry = bits.Add64(lo, C-1, 0)
+		hi, carry = bits.Add64(hi, 0, carry)
+		if carry != 0 {
+			return 0, false
+		}
 	}
 
-	result = x.Uint64()
-
-	if x.Cmp(new(big.Int).SetUint64(math.MaxUint64)) <= 0 {
-		// if x fits in uint64
-		return true
+	// the quotient fits in 64 bits if and only if hi < C
+	if hi >= C {
+		return 0, false
 	}
-	return false
+	res, _ := bits.Div64(hi, lo, C)
+	return res, true
 }
@@ -0,0 +1,196 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scp
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/scp/types"
+)
+
+// testNodeID returns a new NodeID for key b, each call allocates its own
+// key as decoding does
+func testNodeID(b byte) types.NodeID {
+	var key types.Uint256
+	key[0] = b
+	return types.NodeID{Ed25519: &key}
+}
+
+// randomQSet returns a quorum set of at most 3 levels over the nodes of
+// pool, nodes may repeat and thresholds may be out of range
+func randomQSet(r *rand.Rand, pool []byte, depth int) types.SCPQuorumSet {
+	var qSet types.SCPQuorumSet
+	for i := r.Intn(4); i > 0; i-- {
+		qSet.Validators = append(qSet.Validators, testNodeID(pool[r.Intn(len(pool))]))
+	}
+	if depth < 2 {
+		for i := r.Intn(3); i > 0; i-- {
+			qSet.InnerSets = append(qSet.InnerSets, randomQSet(r, pool, depth+1))
+		}
+	}
+	qSet.Threshold = uint32(r.Intn(len(qSet.Validators) + len(qSet.InnerSets) + 2))
+	return qSet
+}
+
+// closestVBlockingSize tries all the subsets of the agreeing nodes and
+// returns the size of the smallest one v-blocking along with the others,
+// -1 if there is none
+func closestVBlockingSize(qSet types.SCPQuorumSet, agree map[nodeKey]struct{},
+	excluded *types.NodeID) int {
+
+	var candidates []types.NodeID
+	var failed []types.NodeID
+	ForAllNodes(qSet, func(n types.NodeID) {
+		switch {
+		case excluded != nil && CompareNodeID(n, *excluded) == 0:
+		case hasKey(agree, n):
+			candidates = append(candidates, n)
+		default:
+			failed = append(failed, n)
+		}
+	})
+	best := -1
+	for mask := 0; mask < 1<<uint(len(candidates)); mask++ {
+		nodeSet := append([]types.NodeID{}, failed...)
+		for i, n := range candidates {
+			if mask&(1<<uint(i)) != 0 {
+				nodeSet = append(nodeSet, n)
+			}
+		}
+		size := len(nodeSet) - len(failed)
+		if (best == -1 || size < best) && IsVBlocking(qSet, nodeSet) {
+			best = size
+		}
+	}
+	return best
+}
+
+func hasKey(nodes map[nodeKey]struct{}, n types.NodeID) bool {
+	_, exist := nodes[keyOf(n)]
+	return exist
+}
+
+func TestFindClosestVBlockingIsMinimal(t *testing.T) {
+	pool := []byte{0, 1, 2, 3, 4, 5, 6}
+	r := rand.New(rand.NewSource(1))
+	for k := 0; k < 20000; k++ {
+		qSet := randomQSet(r, pool, 0)
+		agree := make(map[nodeKey]struct{})
+		for _, b := range pool {
+			if r.Intn(3) != 0 {
+				agree[keyOf(testNodeID(b))] = struct{}{}
+			}
+		}
+		var excluded *types.NodeID
+		if r.Intn(3) == 0 {
+			n := testNodeID(pool[r.Intn(len(pool))])
+			excluded = &n
+		}
+
+		res := findClosestVBlockingF(qSet, agree, excluded)
+		for i := 1; i < len(res); i++ {
+			if CompareNodeID(res[i-1], res[i]) >= 0 {
+				t.Fatalf("case %d: result not sorted", k)
+			}
+		}
+		best := closestVBlockingSize(qSet, agree, excluded)
+		if best == -1 {
+			continue
+		}
+		var nodeSet []types.NodeID
+		ForAllNodes(qSet, func(n types.NodeID) {
+			if !hasKey(agree, n) && (excluded == nil || CompareNodeID(n, *excluded) != 0) {
+				nodeSet = append(nodeSet, n)
+			}
+		})
+		if !IsVBlocking(qSet, append(nodeSet, res...)) {
+			t.Fatalf("case %d: result is not v-blocking", k)
+		}
+		if len(res) != best {
+			t.Fatalf("case %d: got %d nodes, the smallest set has %d", k, len(res), best)
+		}
+	}
+}
+
+func TestFindClosestVBlockingExhaustiveLimit(t *testing.T) {
+	// both of 2 of {a, b, c} and 2 of {a, d, e}: blocking takes 2 nodes,
+	// found after the empty set, the 5 single nodes and one pair
+	qSet := types.SCPQuorumSet{
+		Threshold: 2,
+		InnerSets: []types.SCPQuorumSet{
+			{Threshold: 2, Validators: []types.NodeID{testNodeID(1), testNodeID(2), testNodeID(3)}},
+			{Threshold: 2, Validators: []types.NodeID{testNodeID(1), testNodeID(4), testNodeID(5)}},
+		},
+	}
+	agree := make(map[nodeKey]struct{})
+	for b := byte(1); b <= 5; b++ {
+		agree[keyOf(testNodeID(b))] = struct{}{}
+	}
+
+	if res := findClosestVBlockingExhaustive(qSet, agree, nil, 5, 7); len(res) != 2 {
+		t.Fatalf("got %d nodes, want 2", len(res))
+	}
+	if res := findClosestVBlockingExhaustive(qSet, agree, nil, 5, 6); res != nil {
+		t.Fatalf("got %v past the limit", res)
+	}
+	// a is in both inner sets, FindClosestVBlocking searches too
+	if res := findClosestVBlockingF(qSet, agree, nil); len(res) != 2 {
+		t.Fatalf("got %d nodes, want 2", len(res))
+	}
+}
+
+// sharedQSet returns the quorum set that needs all of k inner sets
+// {t:2, c_i, d_i, a} blocked: a and one node of each inner set are enough,
+// but the entries picked one by one are all the c_i and d_i
+func sharedQSet(k int) (types.SCPQuorumSet, map[nodeKey]struct{}) {
+	qSet := types.SCPQuorumSet{Threshold: 1}
+	agree := map[nodeKey]struct{}{keyOf(testNodeID(0)): {}}
+	for i := 0; i < k; i++ {
+		c, d := byte(1+2*i), byte(2+2*i)
+		qSet.InnerSets = append(qSet.InnerSets, types.SCPQuorumSet{
+			Threshold:  2,
+			Validators: []types.NodeID{testNodeID(c), testNodeID(d), testNodeID(0)},
+		})
+		agree[keyOf(testNodeID(c))] = struct{}{}
+		agree[keyOf(testNodeID(d))] = struct{}{}
+	}
+	return qSet, agree
+}
+
+func TestFindClosestVBlockingPastTheLimit(t *testing.T) {
+	// the search finds a and one node of each inner set
+	qSet, agree := sharedQSet(4)
+	if res := findClosestVBlockingF(qSet, agree, nil); len(res) != 5 {
+		t.Fatalf("got %d nodes, want 5", len(res))
+	}
+
+	// the 2^18 sets of at most 9 of the 19 candidates come before the
+	// minimal one, past maxClosestVBlockingSubsets
+	qSet, agree = sharedQSet(9)
+	res := findClosestVBlockingF(qSet, agree, nil)
+	if !IsVBlocking(qSet, res) {
+		t.Fatalf("%v is not v-blocking", res)
+	}
+	if len(res) != 18 {
+		t.Fatalf("got %d nodes, want the 18 picked one entry at a time", len(res))
+	}
+}
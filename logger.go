@@ -0,0 +1,110 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scp
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+//enum
+type LogLevel int32
+
+const (
+	LogLevelTrace LogLevel = iota
+	LogLevelDebug
+	LogLevelInfo
+	LogLevelError
+)
+
+var logLevelMap = map[int32]string{
+	0: "TRACE",
+	1: "DEBUG",
+	2: "INFO",
+	3: "ERROR",
+}
+
+// ValidEnum validates a proposed value for this enum.  Implements
+// the Enum interface for LogLevel
+func (e LogLevel) ValidEnum(v int32) bool {
+	_, ok := logLevelMap[v]
+	return ok
+}
+
+// String returns the name of `e`
+func (e LogLevel) String() string {
+	name, _ := logLevelMap[int32(e)]
+	return name
+}
+
+// LogField is a key-value pair attached to a log record, such as the slot
+// index or the node a record is about
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// Field builds a LogField
+func Field(key string, value interface{}) LogField {
+	return LogField{Key: key, Value: value}
+}
+
+// Logger receives the log records of SCP, records are only sent for the
+// levels Enabled returns true for
+type Logger interface {
+	Enabled(level LogLevel) bool
+	Log(level LogLevel, msg string, fields ...LogField)
+}
+
+// StdLogger writes the records at or above MinLevel to Logger (the
+// standard logger if nil) as "LEVEL SCP: msg key=value..."
+type StdLogger struct {
+	Logger   *log.Logger
+	MinLevel LogLevel
+}
+
+func (sl *StdLogger) Enabled(level LogLevel) bool {
+	return level >= sl.MinLevel
+}
+
+func (sl *StdLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	if !sl.Enabled(level) {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s SCP: %s", level, msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	if sl.Logger != nil {
+		sl.Logger.Print(b.String())
+	} else {
+		log.Print(b.String())
+	}
+}
+
+// logWith logs through logger, nil is silent
+func logWith(logger Logger, level LogLevel, msg string, fields ...LogField) {
+	if logger != nil && logger.Enabled(level) {
+		logger.Log(level, msg, fields...)
+	}
+}
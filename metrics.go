@@ -0,0 +1,182 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// names of the metrics SCP reports, counters end with _total
+const (
+	// each received envelope ends up counted once as valid, invalid,
+	// stale (duplicates included) or dropped, parked ones when they are
+	// processed
+	MetricEnvelopesReceived = "scp_envelopes_received_total"
+	MetricEnvelopesValid    = "scp_envelopes_valid_total"
+	MetricEnvelopesInvalid  = "scp_envelopes_invalid_total"
+	MetricEnvelopesStale    = "scp_envelopes_stale_total"
+	// parked envelopes expired or evicted before being processed
+	MetricEnvelopesDropped = "scp_envelopes_dropped_total"
+	// nomination rounds of the local node, the first one of a slot starts
+	// with its first nomination, the next ones when the nomination timer
+	// fires
+	MetricNominationRounds = "scp_nomination_rounds_total"
+	// raises of the ballot counter of the local node, its first ballot
+	// aside
+	MetricBallotBumps = "scp_ballot_bumps_total"
+	// nomination and ballot timers that fired
+	MetricTimeouts = "scp_timeouts_total"
+	// times a quorum reached the ballot counter of the local node
+	MetricQuorumHeard = "scp_quorum_heard_total"
+	// seconds from the creation of a slot to its externalization
+	MetricTimeToExternalize = "scp_externalize_seconds"
+)
+
+// Metrics receives the measures of SCP, it must be safe for concurrent
+// use if it is shared
+type Metrics interface {
+	// IncCounter adds one to the counter name
+	IncCounter(name string)
+	// Observe adds value to the histogram name
+	Observe(name string, value float64)
+}
+
+// DefaultMetricsBuckets are the histogram upper bounds, in seconds, used
+// when none are given
+var DefaultMetricsBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// PrometheusMetrics is a Metrics holding its values in memory, it serves
+// them in the Prometheus text format as an http.Handler
+type PrometheusMetrics struct {
+	mMutex      sync.Mutex
+	mBuckets    []float64
+	mCounters   map[string]uint64
+	mHistograms map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // by bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// NPrometheusMetrics initializes the exporter with the histogram upper
+// bounds buckets, DefaultMetricsBuckets if nil
+func (np *PrometheusMetrics) NPrometheusMetrics(buckets []float64) {
+	if buckets == nil {
+		buckets = DefaultMetricsBuckets
+	}
+	np.mBuckets = append([]float64(nil), buckets...)
+	sort.Float64s(np.mBuckets)
+	np.mCounters = make(map[string]uint64)
+	np.mHistograms = make(map[string]*histogram)
+}
+
+func (np *PrometheusMetrics) IncCounter(name string) {
+	np.mMutex.Lock()
+	np.mCounters[name]++
+	np.mMutex.Unlock()
+}
+
+func (np *PrometheusMetrics) Observe(name string, value float64) {
+	np.mMutex.Lock()
+	defer np.mMutex.Unlock()
+	h, exist := np.mHistograms[name]
+	if !exist {
+		h = &histogram{counts: make([]uint64, len(np.mBuckets))}
+		np.mHistograms[name] = h
+	}
+	i := sort.SearchFloat64s(np.mBuckets, value)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += value
+	h.count++
+}
+
+// Counter returns the value of the counter name
+func (np *PrometheusMetrics) Counter(name string) uint64 {
+	np.mMutex.Lock()
+	defer np.mMutex.Unlock()
+	return np.mCounters[name]
+}
+
+// WriteTo writes all the metrics in the Prometheus text format, sorted by
+// name
+func (np *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	np.mMutex.Lock()
+	defer np.mMutex.Unlock()
+
+	bw := bufio.NewWriter(w)
+	var n int64
+	printf := func(format string, a ...interface{}) {
+		c, _ := fmt.Fprintf(bw, format, a...)
+		n += int64(c)
+	}
+
+	names := make([]string, 0, len(np.mCounters))
+	for name := range np.mCounters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		printf("# TYPE %s counter\n%s %d\n", name, name, np.mCounters[name])
+	}
+
+	names = names[:0]
+	for name := range np.mHistograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h := np.mHistograms[name]
+		printf("# TYPE %s histogram\n", name)
+		var cumulative uint64
+		for i, le := range np.mBuckets {
+			cumulative += h.counts[i]
+			printf("%s_bucket{le=\"%s\"} %d\n", name, formatFloat(le), cumulative)
+		}
+		printf("%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+		printf("%s_sum %s\n", name, formatFloat(h.sum))
+		printf("%s_count %d\n", name, h.count)
+	}
+	return n, bw.Flush()
+}
+
+// ServeHTTP serves the metrics to a Prometheus scraper
+func (np *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	np.WriteTo(w)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
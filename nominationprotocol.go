@@ -0,0 +1,138 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Adapted from C++ code by 2014 Stellar Development Foundation and contributors
+
+package scp
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/scp/types"
+)
+
+/**
+ * The NominationProtocol holds the state of the local node in the
+ * nomination protocol of a slot.
+ */
+type NominationProtocol struct {
+	mSlot *Slot
+
+	mNominationStarted bool
+	mRoundNumber       uint32
+	mVotes             []interface{} // X
+	mAccepted          []interface{} // Y
+}
+
+func (nn *NominationProtocol) NNominationProtocol(slot *Slot) {
+	nn.mSlot = slot
+}
+
+// startRound starts the next nomination round
+func (nn *NominationProtocol) startRound() {
+	nn.mRoundNumber++
+	nn.mSlot.mSCP.mDriver.incCounter(MetricNominationRounds)
+}
+
+// ErrNominationStarted is returned when restoring the state of a slot that
+// already started nominating
+var ErrNominationStarted = errors.New("SCP: cannot set state after nomination is started")
+
+// setStateFromEnvelope restores the nomination state of the local node
+// from the latest nomination envelope it emitted
+func (nn *NominationProtocol) setStateFromEnvelope(e types.SCPEnvelope) error {
+	if nn.mNominationStarted {
+		return ErrNominationStarted
+	}
+	return nn.setLocalState(e.Statement)
+}
+
+// setLocalState sets the nomination state of the local node to the one its
+// statement st describes
+func (nn *NominationProtocol) setLocalState(st types.SCPStatement) error {
+	if st.Type != types.SCPStNominate {
+		return errInvalidRestoreEnvelope
+	}
+
+	nom := &st.SCPStNominate
+	nn.mVotes = append([]interface{}{}, nom.Votes...)
+	nn.mAccepted = append([]interface{}{}, nom.Accepted...)
+	return nil
+}
+
+// NominationJsonInfo is the JSON view of the nomination state of a slot,
+// values are rendered with getValueString
+type NominationJsonInfo struct {
+	Started    bool     `json:"started"`
+	Round      uint32   `json:"roundnumber"`
+	Votes      []string `json:"X"`
+	Accepted   []string `json:"Y"`
+	Candidates []string `json:"candidates"`
+}
+
+// getCandidates returns the values a quorum accepted as nominated, the
+// ones that are confirmed nominated, sorted
+func (nn *NominationProtocol) getCandidates() []interface{} {
+	slot := nn.mSlot
+	latest := envelopesByNodeID(slot.mLatestNominations)
+	qFun := func(st types.SCPStatement) *types.SCPQuorumSet {
+		return slot.getQuorumSetFromStatement(st)
+	}
+	localQSet := slot.getLocalQuorumSet()
+
+	var res []interface{}
+	for _, e := range sortLatest(slot.mLatestNominations) {
+		for _, v := range e.Statement.SCPStNominate.Accepted {
+			if SliceIndex(len(res), func(i int) bool { return compareValues(res[i], v) == 0 }) != -1 {
+				continue
+			}
+			filter := func(st types.SCPStatement) bool {
+				accepted := st.SCPStNominate.Accepted
+				return SliceIndex(len(accepted), func(i int) bool {
+					return compareValues(accepted[i], v) == 0
+				}) != -1
+			}
+			if IsQuorum(localQSet, latest, qFun, filter) {
+				res = append(res, v)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return compareValues(res[i], res[j]) < 0 })
+	return res
+}
+
+func (nn *NominationProtocol) getJsonInfo() NominationJsonInfo {
+	return NominationJsonInfo{
+		Started:    nn.mNominationStarted,
+		Round:      nn.mRoundNumber,
+		Votes:      valuesToStr(nn.mVotes),
+		Accepted:   valuesToStr(nn.mAccepted),
+		Candidates: valuesToStr(nn.getCandidates()),
+	}
+}
+
+func valuesToStr(values []interface{}) []string {
+	res := make([]string, 0, len(values))
+	for _, v := range values {
+		res = append(res, getValueString(v))
+	}
+	return res
+}
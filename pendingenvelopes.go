@@ -0,0 +1,209 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scp
+
+import (
+	"bytes"
+
+	"github.com/scp/types"
+)
+
+// by default, envelopes stay parked until the network is this many slots
+// ahead of theirs
+const defaultPendingExpirySlots uint64 = 10
+
+// most envelopes parked for a single node, its oldest ones make room for
+// the new ones
+const maxPendingEnvelopesPerNode = 50
+
+// most envelopes parked at once, new ones are refused beyond
+const maxPendingEnvelopes = 5000
+
+// pendingEnvelope is an envelope waiting for the data behind some hashes
+// (quorum sets, values)
+type pendingEnvelope struct {
+	envelope  types.SCPEnvelope
+	waitingOn map[types.Hash]struct{}
+	seq       uint64 // parking order
+}
+
+// pendingEnvelopes parks the envelopes that can't be processed yet
+type pendingEnvelopes struct {
+	mExpirySlots uint64
+	// parked envelopes by slot index
+	mEnvelopes map[uint64][]*pendingEnvelope
+	// parked envelopes by the hashes they wait on
+	mWaiting map[types.Hash][]*pendingEnvelope
+	mNextSeq uint64
+}
+
+func (np *pendingEnvelopes) NPendingEnvelopes(expirySlots uint64) {
+	np.mExpirySlots = expirySlots
+	np.mEnvelopes = make(map[uint64][]*pendingEnvelope)
+	np.mWaiting = make(map[types.Hash][]*pendingEnvelope)
+}
+
+// has tells if envelope is parked
+func (np *pendingEnvelopes) has(envelope types.SCPEnvelope) bool {
+	data := types.Pack(envelope)
+	for _, p := range np.mEnvelopes[envelope.Statement.SlotIndex] {
+		if bytes.Equal(types.Pack(p.envelope), data) {
+			return true
+		}
+	}
+	return false
+}
+
+// park holds envelope, which must not be parked already, until all the
+// hashes in missing are received. false is returned if the envelope is
+// refused because too many envelopes are parked. The number of parked
+// envelopes dropped to make room is returned too.
+func (np *pendingEnvelopes) park(envelope types.SCPEnvelope, missing []types.Hash) (bool, int) {
+	st := &envelope.Statement
+	var fromNode []*pendingEnvelope
+	for _, parked := range np.mEnvelopes {
+		for _, p := range parked {
+			if CompareNodeID(p.envelope.Statement.NodeID, st.NodeID) == 0 {
+				fromNode = append(fromNode, p)
+			}
+		}
+	}
+	evicted := 0
+	if len(fromNode) >= maxPendingEnvelopesPerNode {
+		oldest := fromNode[0]
+		for _, p := range fromNode {
+			if p.seq < oldest.seq {
+				oldest = p
+			}
+		}
+		np.drop(oldest)
+		evicted++
+	}
+	if np.count() >= maxPendingEnvelopes {
+		return false, evicted
+	}
+
+	p := &pendingEnvelope{
+		envelope:  envelope,
+		waitingOn: make(map[types.Hash]struct{}),
+		seq:       np.mNextSeq,
+	}
+	np.mNextSeq++
+	for _, h := range missing {
+		if _, exist := p.waitingOn[h]; exist {
+			continue
+		}
+		p.waitingOn[h] = struct{}{}
+		np.mWaiting[h] = append(np.mWaiting[h], p)
+	}
+	np.mEnvelopes[st.SlotIndex] = append(np.mEnvelopes[st.SlotIndex], p)
+	return true, evicted
+}
+
+// received marks h as available and returns the envelopes that don't wait
+// on anything anymore, they are no longer parked
+func (np *pendingEnvelopes) received(h types.Hash) []types.SCPEnvelope {
+	var res []types.SCPEnvelope
+	for _, p := range np.mWaiting[h] {
+		delete(p.waitingOn, h)
+		if len(p.waitingOn) == 0 && np.remove(p) {
+			res = append(res, p.envelope)
+		}
+	}
+	delete(np.mWaiting, h)
+	return res
+}
+
+// remove forgets p, false if it was not parked anymore
+func (np *pendingEnvelopes) remove(p *pendingEnvelope) bool {
+	slotIndex := p.envelope.Statement.SlotIndex
+	parked := np.mEnvelopes[slotIndex]
+	index := SliceIndex(len(parked), func(i int) bool { return parked[i] == p })
+	if index == -1 {
+		return false
+	}
+	parked = append(parked[:index], parked[index+1:]...)
+	if len(parked) == 0 {
+		delete(np.mEnvelopes, slotIndex)
+	} else {
+		np.mEnvelopes[slotIndex] = parked
+	}
+	return true
+}
+
+// drop forgets p, which no longer waits on anything
+func (np *pendingEnvelopes) drop(p *pendingEnvelope) {
+	np.remove(p)
+	for h := range p.waitingOn {
+		waiting := np.mWaiting[h]
+		index := SliceIndex(len(waiting), func(i int) bool { return waiting[i] == p })
+		if index == -1 {
+			continue
+		}
+		waiting = append(waiting[:index], waiting[index+1:]...)
+		if len(waiting) == 0 {
+			delete(np.mWaiting, h)
+		} else {
+			np.mWaiting[h] = waiting
+		}
+	}
+}
+
+// expire drops the envelopes of the slots mExpirySlots or more behind
+// highSlotIndex, and the ones below minSlotIndex, it returns how many
+// were dropped
+func (np *pendingEnvelopes) expire(highSlotIndex uint64, minSlotIndex uint64) int {
+	dropped := 0
+	for slotIndex, parked := range np.mEnvelopes {
+		if slotIndex < minSlotIndex || slotIndex+np.mExpirySlots <= highSlotIndex {
+			delete(np.mEnvelopes, slotIndex)
+			dropped += len(parked)
+		}
+	}
+	if dropped == 0 {
+		return 0
+	}
+	// drop them from the index by hash too
+	for h, waiting := range np.mWaiting {
+		var kept []*pendingEnvelope
+		for _, p := range waiting {
+			parked := np.mEnvelopes[p.envelope.Statement.SlotIndex]
+			if SliceIndex(len(parked), func(i int) bool { return parked[i] == p }) != -1 {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(np.mWaiting, h)
+		} else {
+			np.mWaiting[h] = kept
+		}
+	}
+	return dropped
+}
+
+// count returns the number of parked envelopes
+func (np *pendingEnvelopes) count() int {
+	res := 0
+	for _, parked := range np.mEnvelopes {
+		res += len(parked)
+	}
+	return res
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scp
+
+import (
+	"container/list"
+	"crypto/sha256"
+
+	"github.com/scp/types"
+)
+
+// default number of quorum sets kept by SCP, besides the pinned ones
+const defaultQSetCacheSize = 1000
+
+// QuorumSetCache holds quorum sets by hash. Past its capacity the least
+// recently used sets are evicted, pinned sets are never evicted.
+type QuorumSetCache struct {
+	mCapacity int
+	mEntries  map[types.Hash]*list.Element
+	mLRU      *list.List // most recently used first
+	mPinned   map[types.Hash]types.SCPQuorumSet
+}
+
+type qSetCacheEntry struct {
+	hash types.Hash
+	qSet types.SCPQuorumSet
+}
+
+func (nc *QuorumSetCache) NQuorumSetCache(capacity int) {
+	nc.mCapacity = capacity
+	nc.mEntries = make(map[types.Hash]*list.Element)
+	nc.mLRU = list.New()
+	nc.mPinned = make(map[types.Hash]types.SCPQuorumSet)
+}
+
+// QSetHash returns the hash statements use to reference qSet
+func QSetHash(qSet types.SCPQuorumSet) types.Hash {
+	return sha256.Sum256(types.Pack(qSet))
+}
+
+// Get returns the quorum set for qSetHash, nil if it is not held
+func (nc *QuorumSetCache) Get(qSetHash types.Hash) *types.SCPQuorumSet {
+	if qSet, exist := nc.mPinned[qSetHash]; exist {
+		return &qSet
+	}
+	if e, exist := nc.mEntries[qSetHash]; exist {
+		nc.mLRU.MoveToFront(e)
+		qSet := e.Value.(*qSetCacheEntry).qSet
+		return &qSet
+	}
+	return nil
+}
+
+// Add inserts qSet and returns its hash, the least recently used set is
+// evicted if the cache is full
+func (nc *QuorumSetCache) Add(qSet types.SCPQuorumSet) types.Hash {
+	h := QSetHash(qSet)
+	if _, exist := nc.mPinned[h]; exist {
+		return h
+	}
+	if e, exist := nc.mEntries[h]; exist {
+		nc.mLRU.MoveToFront(e)
+		return h
+	}
+
+	nc.mEntries[h] = nc.mLRU.PushFront(&qSetCacheEntry{h, qSet})
+	for nc.mLRU.Len() > nc.mCapacity {
+		oldest := nc.mLRU.Back()
+		nc.mLRU.Remove(oldest)
+		delete(nc.mEntries, oldest.Value.(*qSetCacheEntry).hash)
+	}
+	return h
+}
+
+// Pin inserts qSet so that it is never evicted and returns its hash
+func (nc *QuorumSetCache) Pin(qSet types.SCPQuorumSet) types.Hash {
+	h := QSetHash(qSet)
+	if e, exist := nc.mEntries[h]; exist {
+		nc.mLRU.Remove(e)
+		delete(nc.mEntries, h)
+	}
+	nc.mPinned[h] = qSet
+	return h
+}
+
+// Unpin lets the quorum set for qSetHash be evicted again, as the most
+// recently used one
+func (nc *QuorumSetCache) Unpin(qSetHash types.Hash) {
+	qSet, exist := nc.mPinned[qSetHash]
+	if !exist {
+		return
+	}
+	delete(nc.mPinned, qSetHash)
+	nc.Add(qSet)
+}
+
+// Len returns the number of quorum sets held, pinned ones included
+func (nc *QuorumSetCache) Len() int {
+	return len(nc.mPinned) + nc.mLRU.Len()
+}
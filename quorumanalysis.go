@@ -0,0 +1,168 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scp
+
+import (
+	"github.com/scp/types"
+)
+
+// QuorumAnalysis reports which nodes the safety and the liveness of a
+// network depend on.
+//  * a splitting set is a set of nodes that, by going Byzantine, breaks
+//    quorum intersection
+//  * a blocking set is a set of nodes that, by failing, leaves the rest of
+//    the network without any quorum
+// Only minimal sets are listed, in increasing size.
+type QuorumAnalysis struct {
+	Intersecting  bool             `json:"intersecting"`
+	MaxSetSize    int              `json:"maxSetSize"`
+	SplittingSets [][]types.NodeID `json:"splittingSets"`
+	BlockingSets  [][]types.NodeID `json:"blockingSets"`
+}
+
+// AnalyzeQuorums computes the QuorumAnalysis of the network described by
+// qMap, looking for sets of at most maxSetSize nodes (the search is
+// exponential in maxSetSize)
+func AnalyzeQuorums(qMap map[types.NodeID]types.SCPQuorumSet, maxSetSize int) QuorumAnalysis {
+	return QuorumAnalysis{
+		Intersecting:  CheckQuorumIntersection(qMap).Intersecting,
+		MaxSetSize:    maxSetSize,
+		SplittingSets: FindMinimalSplittingSets(qMap, maxSetSize),
+		BlockingSets:  FindMinimalBlockingSets(qMap, maxSetSize),
+	}
+}
+
+// CheckByzantine tells if the network described by qMap still enjoys
+// quorum intersection when the nodes in byzantine misbehave.
+// Byzantine nodes can vote for anything, so they are deleted from the
+// network: they are removed from every quorum set as if they always agreed.
+func CheckByzantine(qMap map[types.NodeID]types.SCPQuorumSet,
+	byzantine []types.NodeID) QuorumIntersectionResult {
+	return CheckQuorumIntersection(deleteNodes(qMap, byzantine))
+}
+
+// deleteNodes returns the network qMap without the given nodes
+func deleteNodes(qMap map[types.NodeID]types.SCPQuorumSet,
+	nodes []types.NodeID) map[types.NodeID]types.SCPQuorumSet {
+
+	res := make(map[types.NodeID]types.SCPQuorumSet)
+	for n, q := range qMap {
+		index := SliceIndex(len(nodes), func(i int) bool { return CompareNodeID(nodes[i], n) == 0 })
+		if index != -1 {
+			continue
+		}
+		for i := range nodes {
+			q = NormalizeQSet(q, &nodes[i])
+		}
+		res[n] = q
+	}
+	return res
+}
+
+// FindMinimalSplittingSets returns the minimal sets of at most maxSetSize
+// nodes whose misbehavior breaks quorum intersection.
+// If the network is already split, the only minimal set is the empty one.
+func FindMinimalSplittingSets(qMap map[types.NodeID]types.SCPQuorumSet,
+	maxSetSize int) [][]types.NodeID {
+
+	g := newQuorumGraph(qMap)
+	// any node can lie, even the ones we don't know the quorum set of
+	all := g.newSet()
+	for i := range g.nodes {
+		all.set(i)
+	}
+	return g.findMinimalSets(all, maxSetSize, func(s bitSet) bool {
+		return !CheckByzantine(qMap, g.nodesOf(s)).Intersecting
+	})
+}
+
+// FindMinimalBlockingSets returns the minimal sets of at most maxSetSize
+// nodes whose failure leaves no quorum in the network.
+// If there is no quorum at all, the only minimal set is the empty one.
+func FindMinimalBlockingSets(qMap map[types.NodeID]types.SCPQuorumSet,
+	maxSetSize int) [][]types.NodeID {
+
+	g := newQuorumGraph(qMap)
+	// nodes with an unknown quorum set are not part of any quorum anyway
+	known := g.known()
+	return g.findMinimalSets(known, maxSetSize, func(s bitSet) bool {
+		rest := known.clone()
+		s.forEach(rest.unset)
+		return g.contractToMaximalQuorum(rest).empty()
+	})
+}
+
+// findMinimalSets returns the minimal subsets of candidates, of at most
+// maxSetSize nodes, for which pred holds. pred must be monotonic (if it
+// holds for a set, it holds for all its supersets).
+func (g *quorumGraph) findMinimalSets(candidates bitSet, maxSetSize int,
+	pred func(bitSet) bool) [][]types.NodeID {
+
+	var cand []int
+	candidates.forEach(func(i int) {
+		cand = append(cand, i)
+	})
+
+	var found []bitSet
+	res := [][]types.NodeID{}
+	for size := 0; size <= maxSetSize && size <= len(cand); size++ {
+		var newFound []bitSet
+		forEachSubset(len(cand), size, func(subset []int) bool {
+			s := g.newSet()
+			for _, i := range subset {
+				s.set(cand[i])
+			}
+			// supersets of a found set are not minimal
+			for _, f := range found {
+				if f.isSubsetOf(s) {
+					return true
+				}
+			}
+			if pred(s) {
+				newFound = append(newFound, s)
+				res = append(res, g.nodesOf(s))
+			}
+			return true
+		})
+		found = append(found, newFound...)
+	}
+	return res
+}
+
+// forEachSubset runs proc over all the subsets of size k of {0, ..., n-1},
+// in lexicographic order, until proc returns false
+func forEachSubset(n int, k int, proc func(subset []int) bool) {
+	subset := make([]int, k)
+	var rec func(pos int, start int) bool
+	rec = func(pos int, start int) bool {
+		if pos == k {
+			return proc(subset)
+		}
+		for i := start; i <= n-(k-pos); i++ {
+			subset[pos] = i
+			if !rec(pos+1, i+1) {
+				return false
+			}
+		}
+		return true
+	}
+	rec(0, 0)
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scp
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/scp/types"
+)
+
+// QuorumHealthReport describes how the transitive quorum of the local node
+// keeps up with it, as of the highest slot it knows.
+//  * LaggingVBlocking is set when the nodes that are behind (or were never
+//    heard) are v-blocking for the local quorum set: the local node can't
+//    make progress without them
+//  * Intersecting tells if the quorum sets announced by the nodes enjoy
+//    quorum intersection
+type QuorumHealthReport struct {
+	SlotIndex        uint64       `json:"slotIndex"`
+	Phase            string       `json:"phase"`
+	LaggingVBlocking bool         `json:"laggingVBlocking"`
+	Intersecting     bool         `json:"intersecting"`
+	Nodes            []NodeHealth `json:"nodes"`
+}
+
+// NodeHealth is the state of a node of the transitive quorum.
+//  * LastSeenSlot is the highest slot the node sent a statement for, Lag
+//    how many slots it is behind the local node. Nodes never seen lag by
+//    all the known slots.
+//  * Phase is the phase of the node on the highest slot, empty if it sent
+//    nothing for it, PhaseAgree is set if it is the one of the local node
+//  * IntersectsWithout tells if quorum intersection still holds with this
+//    node misbehaving, it is only computed on demand (nil otherwise) as it
+//    takes a full intersection check per node
+type NodeHealth struct {
+	NodeID            types.NodeID `json:"nodeID"`
+	Name              string       `json:"name"`
+	Seen              bool         `json:"seen"`
+	LastSeenSlot      uint64       `json:"lastSeenSlot"`
+	Lag               uint64       `json:"lag"`
+	Phase             string       `json:"phase"`
+	PhaseAgree        bool         `json:"phaseAgree"`
+	IntersectsWithout *bool        `json:"intersectsWithout,omitempty"`
+}
+
+// getQuorumHealth computes the QuorumHealthReport of the local node, the
+// intersection without each node is checked if checkNodes is set
+func (ns *SCP) getQuorumHealth(checkNodes bool) QuorumHealthReport {
+	highSlotIndex := ns.getHighSlotIndex()
+	localID := ns.mLocalNode.NodeID()
+	localQSet, _ := ns.mLocalNode.QuorumSetForSlot(highSlotIndex)
+
+	// known slots, newest first, with their latest statements by node
+	type slotStatements struct {
+		slot        *Slot
+		nominations []types.SCPEnvelope
+		ballots     []types.SCPEnvelope
+	}
+	var slots []slotStatements
+	for _, slot := range ns.mKnownSlots {
+		slots = append(slots, slotStatements{slot,
+			sortLatest(slot.mLatestNominations), sortLatest(slot.mLatestEnvelopes)})
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].slot.mSlotIndex > slots[j].slot.mSlotIndex })
+
+	// the quorum set a node announced on the most recent slot
+	qSetOf := func(n types.NodeID) *types.SCPQuorumSet {
+		for _, s := range slots {
+			for _, latest := range [][]types.SCPEnvelope{s.nominations, s.ballots} {
+				if e := findLatest(latest, n); e != nil {
+					qSet := ns.getQSet(getCompanionQuorumSetHashFromStatement(e.Statement))
+					if qSet != nil {
+						return qSet
+					}
+				}
+			}
+		}
+		return nil
+	}
+	nodes := transitiveQuorum(localQSet, func(n types.NodeID) []types.SCPQuorumSet {
+		if qSet := qSetOf(n); qSet != nil {
+			return []types.SCPQuorumSet{*qSet}
+		}
+		return nil
+	})
+
+	// last seen slots, from the statements history
+	seen := make([]bool, len(nodes))
+	lastSeen := make([]uint64, len(nodes))
+	for _, s := range slots {
+		for _, h := range s.slot.mStatementsHistory {
+			i := indexOfNode(nodes, h.mStatement.NodeID)
+			if i != -1 && (!seen[i] || lastSeen[i] < s.slot.mSlotIndex) {
+				seen[i] = true
+				lastSeen[i] = s.slot.mSlotIndex
+			}
+		}
+	}
+
+	qMap := make(map[types.NodeID]types.SCPQuorumSet)
+	qMap[localID] = localQSet
+	for _, n := range nodes {
+		if CompareNodeID(n, localID) == 0 {
+			continue
+		}
+		if qSet := qSetOf(n); qSet != nil {
+			qMap[n] = *qSet
+		}
+	}
+
+	res := QuorumHealthReport{
+		SlotIndex:    highSlotIndex,
+		Intersecting: CheckQuorumIntersection(qMap).Intersecting,
+		Nodes:        []NodeHealth{},
+	}
+	var high *slotStatements
+	if len(slots) != 0 {
+		high = &slots[0]
+		res.Phase = nominatePhaseName
+		if started, phase, _ := high.slot.getLocalBallotState(); started {
+			res.Phase = phase.String()
+		}
+	}
+
+	var lagging []types.NodeID
+	for i, n := range nodes {
+		if CompareNodeID(n, localID) == 0 {
+			continue
+		}
+		h := NodeHealth{
+			NodeID:       n,
+			Name:         toShortString(n),
+			Seen:         seen[i],
+			LastSeenSlot: lastSeen[i],
+		}
+		if checkNodes {
+			intersecting := CheckByzantine(qMap, []types.NodeID{n}).Intersecting
+			h.IntersectsWithout = &intersecting
+		}
+		if seen[i] {
+			h.Lag = highSlotIndex - lastSeen[i]
+		} else if len(slots) != 0 {
+			h.Lag = highSlotIndex - ns.getLowSlotIndex() + 1
+		}
+		if high != nil {
+			if e := findLatest(high.ballots, n); e != nil {
+				h.Phase = getStatementPhase(e.Statement).String()
+			} else if findLatest(high.nominations, n) != nil {
+				h.Phase = nominatePhaseName
+			}
+			h.PhaseAgree = h.Phase == res.Phase
+		}
+		if h.Lag != 0 {
+			lagging = append(lagging, n)
+		}
+		res.Nodes = append(res.Nodes, h)
+	}
+	res.LaggingVBlocking = IsVBlocking(localQSet, lagging)
+	return res
+}
+
+// getJsonQuorumHealth dumps getQuorumHealth as JSON
+func (ns *SCP) getJsonQuorumHealth(checkNodes bool) string {
+	fw, err := json.Marshal(ns.getQuorumHealth(checkNodes))
+	if err != nil {
+		ns.mDriver.log(LogLevelError, "getJsonQuorumHealth", Field("error", err))
+	}
+	return string(fw)
+}
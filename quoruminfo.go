@@ -0,0 +1,230 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Adapted from C++ code by 2014 Stellar Development Foundation and contributors
+
+package scp
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/scp/types"
+)
+
+// QuorumInfo sorts the nodes of the transitive quorum of the local node
+// by how they follow it on a slot, the local node itself is left out.
+//  * Missing nodes sent no statement for the slot
+//  * Delayed nodes are in an older phase than the local node (nominating
+//    while it is balloting, preparing while it confirms...)
+//  * Disagreeing nodes work on a ballot for another value
+//  * Agreeing nodes are the others
+// Phase is the phase of the local node, "NOMINATE" before it starts
+// balloting.
+type QuorumInfo struct {
+	SlotIndex uint64         `json:"slotIndex"`
+	Phase     string         `json:"phase"`
+	Agree     []types.NodeID `json:"agree"`
+	Missing   []types.NodeID `json:"missing"`
+	Delayed   []types.NodeID `json:"delayed"`
+	Disagree  []types.NodeID `json:"disagree"`
+}
+
+// name of the phase of the nodes that didn't start balloting
+const nominatePhaseName = "NOMINATE"
+
+// getQuorumInfo reports who is following the local node on slotIndex
+func (ns *SCP) getQuorumInfo(slotIndex uint64) QuorumInfo {
+	slot := ns.getSlot(slotIndex, false)
+	if slot == nil {
+		// nothing was heard for the slot, everybody is missing
+		qSet, _ := ns.mLocalNode.QuorumSetForSlot(slotIndex)
+		res := QuorumInfo{SlotIndex: slotIndex, Phase: nominatePhaseName}
+		ForAllNodes(qSet, func(n types.NodeID) {
+			if CompareNodeID(n, ns.mLocalNode.NodeID()) != 0 {
+				res.Missing = append(res.Missing, n)
+			}
+		})
+		sortNodeIDs(res.Missing)
+		return res
+	}
+	return slot.getQuorumInfo()
+}
+
+// getJsonQuorumInfo dumps getQuorumInfo as JSON
+func (ns *SCP) getJsonQuorumInfo(slotIndex uint64) string {
+	fw, err := json.Marshal(ns.getQuorumInfo(slotIndex))
+	if err != nil {
+		ns.mDriver.log(LogLevelError, "getJsonQuorumInfo", Field("error", err))
+	}
+	return string(fw)
+}
+
+func (ns *Slot) getQuorumInfo() QuorumInfo {
+	res := QuorumInfo{SlotIndex: ns.mSlotIndex, Phase: nominatePhaseName}
+
+	// the local node is balloting with value if started
+	started, phase, value := ns.getLocalBallotState()
+	if started {
+		res.Phase = phase.String()
+	}
+
+	nominations := sortLatest(ns.mLatestNominations)
+	ballots := sortLatest(ns.mLatestEnvelopes)
+	localID := ns.mSCP.mLocalNode.NodeID()
+	for _, n := range ns.getTransitiveQuorum(nominations, ballots) {
+		if CompareNodeID(n, localID) == 0 {
+			continue
+		}
+		ballot := findLatest(ballots, n)
+		switch {
+		case ballot == nil && findLatest(nominations, n) == nil:
+			res.Missing = append(res.Missing, n)
+		case ballot == nil:
+			if started {
+				res.Delayed = append(res.Delayed, n)
+			} else {
+				res.Agree = append(res.Agree, n)
+			}
+		case started && compareValues(getWorkingBallot(ballot.Statement).Value, value) != 0:
+			res.Disagree = append(res.Disagree, n)
+		case started && getStatementPhase(ballot.Statement) < phase:
+			res.Delayed = append(res.Delayed, n)
+		default:
+			res.Agree = append(res.Agree, n)
+		}
+	}
+	return res
+}
+
+// getLocalBallotState returns the phase and value of the local node in the
+// ballot protocol, started is false if it is not balloting. Watchers follow
+// the slot until it externalizes.
+func (ns *Slot) getLocalBallotState() (started bool, phase SCPPhase, value interface{}) {
+	if ns.mExternalized {
+		return true, SCPPhaseExternalize, ns.mExternalizedValue
+	}
+	bp := &ns.mBallotProtocol
+	if bp.mCurrentBallot == nil {
+		return false, SCPPhasePrepare, nil
+	}
+	return true, bp.mPhase, bp.mCurrentBallot.Value
+}
+
+// getStatementPhase returns the phase a ballot statement was sent from
+func getStatementPhase(st types.SCPStatement) SCPPhase {
+	switch st.Type {
+	case types.SCPStConfirm:
+		return SCPPhaseConfirm
+	case types.SCPStExternalize:
+		return SCPPhaseExternalize
+	}
+	return SCPPhasePrepare
+}
+
+// getTransitiveQuorum returns the nodes reachable from the local quorum set
+// of the slot through the quorum sets of the statements received, sorted
+func (ns *Slot) getTransitiveQuorum(nominations []types.SCPEnvelope,
+	ballots []types.SCPEnvelope) []types.NodeID {
+
+	return transitiveQuorum(ns.getLocalQuorumSet(), func(n types.NodeID) []types.SCPQuorumSet {
+		var res []types.SCPQuorumSet
+		for _, latest := range [][]types.SCPEnvelope{nominations, ballots} {
+			e := findLatest(latest, n)
+			if e == nil {
+				continue
+			}
+			// EXTERNALIZE statements also carry the quorum set the node
+			// committed with
+			qSet := ns.mSCP.getQSet(getCompanionQuorumSetHashFromStatement(e.Statement))
+			if qSet != nil {
+				res = append(res, *qSet)
+			}
+		}
+		return res
+	})
+}
+
+// transitiveQuorum returns the nodes reachable from qSet, sorted, through
+// the quorum sets qSetsOf knows for each node
+func transitiveQuorum(qSet types.SCPQuorumSet,
+	qSetsOf func(types.NodeID) []types.SCPQuorumSet) []types.NodeID {
+
+	var res []types.NodeID
+	var queue []types.NodeID
+	visit := func(n types.NodeID) {
+		i := sort.Search(len(res), func(i int) bool { return CompareNodeID(res[i], n) >= 0 })
+		if i < len(res) && CompareNodeID(res[i], n) == 0 {
+			return
+		}
+		res = append(res, types.NodeID{})
+		copy(res[i+1:], res[i:])
+		res[i] = n
+		queue = append(queue, n)
+	}
+
+	ForAllNodes(qSet, visit)
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, q := range qSetsOf(n) {
+			ForAllNodes(q, visit)
+		}
+	}
+	return res
+}
+
+// indexOfNode returns the position of nodeID in the sorted nodes, -1 if it
+// is not there
+func indexOfNode(nodes []types.NodeID, nodeID types.NodeID) int {
+	i := sort.Search(len(nodes), func(i int) bool { return CompareNodeID(nodes[i], nodeID) >= 0 })
+	if i < len(nodes) && CompareNodeID(nodes[i], nodeID) == 0 {
+		return i
+	}
+	return -1
+}
+
+// sortLatest returns the envelopes of latest sorted by node for findLatest
+func sortLatest(latest map[nodeKey]types.SCPEnvelope) []types.SCPEnvelope {
+	res := make([]types.SCPEnvelope, 0, len(latest))
+	for _, e := range latest {
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return CompareNodeID(res[i].Statement.NodeID, res[j].Statement.NodeID) < 0
+	})
+	return res
+}
+
+// findLatest returns the envelope of nodeID in sorted, compared by value as
+// quorum sets and statements don't share their node IDs
+func findLatest(sorted []types.SCPEnvelope, nodeID types.NodeID) *types.SCPEnvelope {
+	i := sort.Search(len(sorted), func(i int) bool {
+		return CompareNodeID(sorted[i].Statement.NodeID, nodeID) >= 0
+	})
+	if i < len(sorted) && CompareNodeID(sorted[i].Statement.NodeID, nodeID) == 0 {
+		return &sorted[i]
+	}
+	return nil
+}
+
+func sortNodeIDs(nodes []types.NodeID) {
+	sort.Slice(nodes, func(i, j int) bool { return CompareNodeID(nodes[i], nodes[j]) < 0 })
+}
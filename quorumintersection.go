@@ -0,0 +1,325 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Adapted from C++ code by 2014 Stellar Development Foundation and contributors
+
+package scp
+
+import (
+	"math/bits"
+	"sort"
+
+	"github.com/scp/types"
+)
+
+// QuorumIntersectionResult is the outcome of CheckQuorumIntersection.
+// When the network is split, QuorumA and QuorumB are two disjoint quorums.
+type QuorumIntersectionResult struct {
+	Intersecting bool           `json:"intersecting"`
+	QuorumA      []types.NodeID `json:"quorumA,omitempty"`
+	QuorumB      []types.NodeID `json:"quorumB,omitempty"`
+}
+
+// CheckQuorumIntersection tells if every two quorums of the network
+// described by qMap (node -> its quorum set) intersect.
+// Nodes are compared by value, nodes without a known quorum set can't be
+// part of any quorum.
+func CheckQuorumIntersection(qMap map[types.NodeID]types.SCPQuorumSet) QuorumIntersectionResult {
+	return newQuorumGraph(qMap).checkIntersection()
+}
+
+// bitSet is a set of node indices within a quorumGraph
+type bitSet []uint64
+
+func newBitSet(size int) bitSet {
+	return make(bitSet, (size+63)/64)
+}
+
+func (b bitSet) has(i int) bool {
+	return b[i/64]&(1<<uint(i%64)) != 0
+}
+
+func (b bitSet) set(i int) {
+	b[i/64] |= 1 << uint(i%64)
+}
+
+func (b bitSet) unset(i int) {
+	b[i/64] &^= 1 << uint(i%64)
+}
+
+func (b bitSet) clone() bitSet {
+	return append(bitSet(nil), b...)
+}
+
+func (b bitSet) count() int {
+	c := 0
+	for _, w := range b {
+		c += bits.OnesCount64(w)
+	}
+	return c
+}
+
+func (b bitSet) empty() bool {
+	for _, w := range b {
+		if w != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isSubsetOf tells if b \subseteq o
+func (b bitSet) isSubsetOf(o bitSet) bool {
+	for i, w := range b {
+		if w&^o[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// forEach runs proc over the members of b, in increasing order
+func (b bitSet) forEach(proc func(i int)) {
+	for wi, w := range b {
+		for w != 0 {
+			proc(wi*64 + bits.TrailingZeros64(w))
+			w &= w - 1
+		}
+	}
+}
+
+// indexedQSet is a SCPQuorumSet referencing nodes by index
+type indexedQSet struct {
+	threshold  int
+	validators []int
+	innerSets  []indexedQSet
+}
+
+// quorumGraph is a network of quorum sets, nodes are sorted by value and
+// identified by their position in nodes
+type quorumGraph struct {
+	nodes []types.NodeID
+	qSets []*indexedQSet // nil if the quorum set of the node is unknown
+}
+
+func newQuorumGraph(qMap map[types.NodeID]types.SCPQuorumSet) *quorumGraph {
+	var all []types.NodeID
+	for n, q := range qMap {
+		all = append(all, n)
+		ForAllNodes(q, func(v types.NodeID) {
+			all = append(all, v)
+		})
+	}
+	sort.Slice(all, func(i, j int) bool { return CompareNodeID(all[i], all[j]) < 0 })
+
+	g := &quorumGraph{}
+	for _, n := range all {
+		if len(g.nodes) == 0 || CompareNodeID(g.nodes[len(g.nodes)-1], n) != 0 {
+			g.nodes = append(g.nodes, n)
+		}
+	}
+	g.qSets = make([]*indexedQSet, len(g.nodes))
+	for n, q := range qMap {
+		iq := g.indexQSet(q)
+		g.qSets[g.index(n)] = &iq
+	}
+	return g
+}
+
+// index returns the position of nodeID in g, -1 if not found
+func (g *quorumGraph) index(nodeID types.NodeID) int {
+	i := sort.Search(len(g.nodes), func(i int) bool { return CompareNodeID(g.nodes[i], nodeID) >= 0 })
+	if i < len(g.nodes) && CompareNodeID(g.nodes[i], nodeID) == 0 {
+		return i
+	}
+	return -1
+}
+
+// called recursively
+func (g *quorumGraph) indexQSet(qSet types.SCPQuorumSet) indexedQSet {
+	res := indexedQSet{threshold: int(qSet.Threshold)}
+	for _, v := range qSet.Validators {
+		res.validators = append(res.validators, g.index(v))
+	}
+	for _, inner := range qSet.InnerSets {
+		res.innerSets = append(res.innerSets, g.indexQSet(inner))
+	}
+	return res
+}
+
+func (g *quorumGraph) newSet() bitSet {
+	return newBitSet(len(g.nodes))
+}
+
+// nodesOf returns the nodes of s
+func (g *quorumGraph) nodesOf(s bitSet) []types.NodeID {
+	var res []types.NodeID
+	s.forEach(func(i int) {
+		res = append(res, g.nodes[i])
+	})
+	return res
+}
+
+// known returns all the nodes with a known quorum set
+func (g *quorumGraph) known() bitSet {
+	res := g.newSet()
+	for i, q := range g.qSets {
+		if q != nil {
+			res.set(i)
+		}
+	}
+	return res
+}
+
+// isSliceOf tells if s contains a slice of qSet, unlike
+// isQuorumSliceInternal a threshold of 0 is always satisfied (this is what
+// is left after removing the nodes that are assumed to agree)
+func isSliceOf(qSet *indexedQSet, s bitSet) bool {
+	thresholdLeft := qSet.threshold
+	if thresholdLeft <= 0 {
+		return true
+	}
+	for _, v := range qSet.validators {
+		if s.has(v) {
+			thresholdLeft--
+			if thresholdLeft <= 0 {
+				return true
+			}
+		}
+	}
+	for i := range qSet.innerSets {
+		if isSliceOf(&qSet.innerSets[i], s) {
+			thresholdLeft--
+			if thresholdLeft <= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contractToMaximalQuorum returns the largest quorum contained in s, empty
+// if there is none
+func (g *quorumGraph) contractToMaximalQuorum(s bitSet) bitSet {
+	res := s.clone()
+	for changed := true; changed; {
+		changed = false
+		res.forEach(func(i int) {
+			if g.qSets[i] == nil || !isSliceOf(g.qSets[i], res) {
+				res.unset(i)
+				changed = true
+			}
+		})
+	}
+	return res
+}
+
+// isMinimalQuorum tells if the quorum q has no proper subset that is
+// itself a quorum
+func (g *quorumGraph) isMinimalQuorum(q bitSet) bool {
+	minimal := true
+	q.forEach(func(i int) {
+		if !minimal {
+			return
+		}
+		sub := q.clone()
+		sub.unset(i)
+		if !g.contractToMaximalQuorum(sub).empty() {
+			minimal = false
+		}
+	})
+	return minimal
+}
+
+// findDisjointQuorum returns a quorum disjoint from q, empty if there is none
+func (g *quorumGraph) findDisjointQuorum(q bitSet) bitSet {
+	rest := g.known()
+	q.forEach(rest.unset)
+	return g.contractToMaximalQuorum(rest)
+}
+
+func (g *quorumGraph) checkIntersection() QuorumIntersectionResult {
+	var split [2]bitSet
+	// if two quorums are disjoint, one of them has at most half the nodes
+	// and contains a minimal quorum that is disjoint from the other one
+	maxCommit := g.known().count() / 2
+	if g.findSplit(g.newSet(), g.known(), maxCommit, &split) {
+		return QuorumIntersectionResult{
+			Intersecting: false,
+			QuorumA:      g.nodesOf(split[0]),
+			QuorumB:      g.nodesOf(split[1]),
+		}
+	}
+	return QuorumIntersectionResult{Intersecting: true}
+}
+
+// findSplit enumerates the minimal quorums containing committed and
+// contained in committed \cup remaining, it stops at the first one that has
+// a disjoint quorum, storing both quorums in split
+// (this is the pruned enumeration described by Lachowski)
+func (g *quorumGraph) findSplit(committed bitSet, remaining bitSet,
+	maxCommit int, split *[2]bitSet) bool {
+
+	if committed.count() > maxCommit {
+		return false
+	}
+
+	// any extension of a set that contains a quorum is not minimal
+	committedQuorum := g.contractToMaximalQuorum(committed)
+	if !committedQuorum.empty() {
+		if !g.isMinimalQuorum(committedQuorum) {
+			return false
+		}
+		if other := g.findDisjointQuorum(committedQuorum); !other.empty() {
+			split[0] = committedQuorum
+			split[1] = other
+			return true
+		}
+		return false
+	}
+
+	// all quorums left to explore are within the perimeter
+	perimeter := committed.clone()
+	remaining.forEach(perimeter.set)
+	extension := g.contractToMaximalQuorum(perimeter)
+	if extension.empty() || !committed.isSubsetOf(extension) {
+		return false
+	}
+
+	next := extension.clone()
+	committed.forEach(next.unset)
+	split1 := -1
+	next.forEach(func(i int) {
+		if split1 == -1 {
+			split1 = i
+		}
+	})
+	if split1 == -1 {
+		return false
+	}
+
+	next.unset(split1)
+	if g.findSplit(committed, next, maxCommit, split) {
+		return true
+	}
+	withNode := committed.clone()
+	withNode.set(split1)
+	return g.findSplit(withNode, next, maxCommit, split)
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scp
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/scp/types"
+)
+
+// flatQSet returns the quorum set {t: threshold, v: nodes}
+func flatQSet(threshold uint32, nodes ...byte) types.SCPQuorumSet {
+	qSet := types.SCPQuorumSet{Threshold: threshold}
+	for _, b := range nodes {
+		qSet.Validators = append(qSet.Validators, testNodeID(b))
+	}
+	return qSet
+}
+
+// isQuorumOf tells if nodes is a non empty quorum of the network qMap
+func isQuorumOf(qMap map[types.NodeID]types.SCPQuorumSet, nodes []types.NodeID) bool {
+	if len(nodes) == 0 {
+		return false
+	}
+	for _, n := range nodes {
+		found := false
+		for m, qSet := range qMap {
+			if CompareNodeID(m, n) == 0 {
+				found = true
+				if !IsQuorumSlice(qSet, nodes) {
+					return false
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSplit checks that res reports two disjoint quorums of qMap
+func checkSplit(t *testing.T, qMap map[types.NodeID]types.SCPQuorumSet, res QuorumIntersectionResult) {
+	t.Helper()
+	if !isQuorumOf(qMap, res.QuorumA) || !isQuorumOf(qMap, res.QuorumB) {
+		t.Fatalf("witnesses %v and %v are not both quorums", res.QuorumA, res.QuorumB)
+	}
+	for _, a := range res.QuorumA {
+		for _, b := range res.QuorumB {
+			if CompareNodeID(a, b) == 0 {
+				t.Fatalf("witnesses %v and %v intersect", res.QuorumA, res.QuorumB)
+			}
+		}
+	}
+}
+
+func TestCheckQuorumIntersection(t *testing.T) {
+	both := types.SCPQuorumSet{Threshold: 2,
+		InnerSets: []types.SCPQuorumSet{flatQSet(2, 1, 2, 3), flatQSet(2, 4, 5, 6)}}
+	tests := []struct {
+		name         string
+		qMap         map[types.NodeID]types.SCPQuorumSet
+		intersecting bool
+	}{
+		{"majority of 4", map[types.NodeID]types.SCPQuorumSet{
+			testNodeID(1): flatQSet(3, 1, 2, 3, 4),
+			testNodeID(2): flatQSet(3, 1, 2, 3, 4),
+			testNodeID(3): flatQSet(3, 1, 2, 3, 4),
+			testNodeID(4): flatQSet(3, 1, 2, 3, 4),
+		}, true},
+		{"half of 4", map[types.NodeID]types.SCPQuorumSet{
+			testNodeID(1): flatQSet(2, 1, 2, 3, 4),
+			testNodeID(2): flatQSet(2, 1, 2, 3, 4),
+			testNodeID(3): flatQSet(2, 1, 2, 3, 4),
+			testNodeID(4): flatQSet(2, 1, 2, 3, 4),
+		}, false},
+		{"two groups", map[types.NodeID]types.SCPQuorumSet{
+			testNodeID(1): flatQSet(2, 1, 2, 3),
+			testNodeID(2): flatQSet(2, 1, 2, 3),
+			testNodeID(3): flatQSet(2, 1, 2, 3),
+			testNodeID(4): flatQSet(2, 4, 5, 6),
+			testNodeID(5): flatQSet(2, 4, 5, 6),
+			testNodeID(6): flatQSet(2, 4, 5, 6),
+		}, false},
+		{"majorities of two groups", map[types.NodeID]types.SCPQuorumSet{
+			testNodeID(1): both,
+			testNodeID(2): both,
+			testNodeID(3): both,
+			testNodeID(4): both,
+			testNodeID(5): both,
+			testNodeID(6): both,
+		}, true},
+		{"unknown quorum set", map[types.NodeID]types.SCPQuorumSet{
+			testNodeID(1): flatQSet(1, 1, 2),
+			testNodeID(2): flatQSet(1, 3),
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := CheckQuorumIntersection(tt.qMap)
+			if res.Intersecting != tt.intersecting {
+				t.Fatalf("got intersecting %v, want %v", res.Intersecting, tt.intersecting)
+			}
+			if !res.Intersecting {
+				checkSplit(t, tt.qMap, res)
+			} else if res.QuorumA != nil || res.QuorumB != nil {
+				t.Fatalf("got witnesses %v and %v for intersecting quorums", res.QuorumA, res.QuorumB)
+			}
+		})
+	}
+}
+
+// hasDisjointQuorums tries all the pairs of node subsets of qMap, whose
+// nodes are within pool
+func hasDisjointQuorums(qMap map[types.NodeID]types.SCPQuorumSet, pool []byte) bool {
+	var quorums []int
+	for mask := 1; mask < 1<<uint(len(pool)); mask++ {
+		if isQuorumOf(qMap, nodeSubset(pool, mask)) {
+			quorums = append(quorums, mask)
+		}
+	}
+	for _, a := range quorums {
+		for _, b := range quorums {
+			if a&b == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestCheckQuorumIntersectionBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	pool := []byte{1, 2, 3, 4, 5, 6}
+	for c := 0; c < 2000; c++ {
+		qMap := make(map[types.NodeID]types.SCPQuorumSet)
+		for _, b := range pool[:2+r.Intn(len(pool)-1)] {
+			left := append([]byte{}, pool...)
+			r.Shuffle(len(left), func(i, j int) { left[i], left[j] = left[j], left[i] })
+			qMap[testNodeID(b)] = distinctQSet(r, &left, 1)
+		}
+		res := CheckQuorumIntersection(qMap)
+		if want := !hasDisjointQuorums(qMap, pool); res.Intersecting != want {
+			t.Fatalf("case %d: got intersecting %v, want %v", c, res.Intersecting, want)
+		}
+		if !res.Intersecting {
+			checkSplit(t, qMap, res)
+		}
+	}
+}
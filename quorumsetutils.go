@@ -23,12 +23,15 @@
 package scp
 
 import (
+	"bytes"
+	"sort"
+
 	"github.com/scp/types"
 )
 
 type QuorumSetSanityChecker struct {
 	mExtraChecks bool
-	mKnownNodes  map[types.PublicKey]struct{}
+	mKnownNodes  map[nodeKey]struct{}
 	mIsSane      bool
 	mCount       int
 }
@@ -38,8 +41,9 @@ func (nq *QuorumSetSanityChecker) IsSane() bool {
 }
 
 func (nq *QuorumSetSanityChecker) NQuorumSetSanityChecker(qSet types.SCPQuorumSet, extraChecks bool) {
-	nq.mIsSane = nq.CheckSanity(qSet, 0) && nq.mCount >= 1 && nq.mCount <= 1000
 	nq.mExtraChecks = extraChecks
+	nq.mKnownNodes = make(map[nodeKey]struct{})
+	nq.mIsSane = nq.CheckSanity(qSet, 0) && nq.mCount >= 1 && nq.mCount <= 1000
 }
 
 func (nq *QuorumSetSanityChecker) CheckSanity(qSet types.SCPQuorumSet, depth int) bool {
@@ -67,19 +71,17 @@ func (nq *QuorumSetSanityChecker) CheckSanity(qSet types.SCPQuorumSet, depth int
 	}
 
 	for _, n := range v {
-		{
-			if _, exist := nq.mKnownNodes[n]; exist {
-				// n was already present
-				return false
-			}
-			// insert
-			nq.mKnownNodes[n] = struct{}{}
+		if _, exist := nq.mKnownNodes[keyOf(n)]; exist {
+			// n was already present
+			return false
 		}
+		// insert
+		nq.mKnownNodes[keyOf(n)] = struct{}{}
+	}
 
-		for _, iSet := range i {
-			if !nq.CheckSanity(iSet, depth+1) {
-				return false
-			}
+	for _, iSet := range i {
+		if !nq.CheckSanity(iSet, depth+1) {
+			return false
 		}
 	}
 	return true
@@ -91,31 +93,156 @@ func IsQuorumSetSane(qSet types.SCPQuorumSet, extraChecks bool) bool {
 	return checker.IsSane()
 }
 
-// helper function that:
+// NormalizeQSet returns a normalized copy of qSet, qSet itself is left
+// untouched. If idToRemove is set, that node is removed from the set and
+// every threshold it appeared in is lowered accordingly (it is considered
+// to always agree, as done for the local node).
 //  * simplifies singleton inner set into outerset
 //      { t: n, v: { ... }, { t: 1, X }, ... }
 //        into
 //      { t: n, v: { ..., X }, .... }
 //  * simplifies singleton innersets
 //      { t:1, { innerSet } } into innerSet
-func NormalizeQSet(qSet *types.SCPQuorumSet) {
-	v := qSet.Validators
-	iS := qSet.InnerSets
-	for i := len(iS) - 1; i >= 0; i-- {
-		NormalizeQSet(&iS[i])
-		// merge singleton inner sets into validator list
-		if iS[i].Threshold == 1 && len(iS[i].Validators) == 1 &&
-			len(iS[i].InnerSets) == 0 {
-			v = append(v, iS[i].Validators[0])
-			iS = append(iS[:i], iS[i+1:]...)
+//  * removes inner sets always satisfied, the ones that can never be
+//    are replaced by { t:1 } and kept
+//  * removes repeated validators within a set
+//  * sorts validators and inner sets
+func NormalizeQSet(qSet types.SCPQuorumSet, idToRemove *types.NodeID) types.SCPQuorumSet {
+	res := normalizeQSetSimplify(qSet, idToRemove)
+	normalizeQSetReorder(&res)
+	return res
+}
+
+// called recursively, builds a new set
+func normalizeQSetSimplify(qSet types.SCPQuorumSet, idToRemove *types.NodeID) types.SCPQuorumSet {
+	res := types.SCPQuorumSet{Threshold: qSet.Threshold}
+
+	for _, n := range qSet.Validators {
+		if idToRemove != nil && CompareNodeID(n, *idToRemove) == 0 {
+			if res.Threshold > 0 {
+				res.Threshold--
+			}
+			continue
 		}
+		res.Validators = append(res.Validators, n)
+	}
+
+	for _, inner := range qSet.InnerSets {
+		iS := normalizeQSetSimplify(inner, idToRemove)
+		switch {
+		case iS.Threshold == 0:
+			// always satisfied, it is not an entry
+			if res.Threshold > 0 {
+				res.Threshold--
+			}
+		case iS.Threshold == 1 && len(iS.Validators) == 1 && len(iS.InnerSets) == 0:
+			// merge singleton inner sets into validator list
+			res.Validators = append(res.Validators, iS.Validators[0])
+		default:
+			res.InnerSets = append(res.InnerSets, iS)
+		}
+	}
+
+	res.Validators = dedupNodeIDs(res.Validators)
+	if total := uint32(len(res.Validators) + len(res.InnerSets)); res.Threshold > total {
+		// it can never be satisfied, the parent keeps it as an entry
+		return types.SCPQuorumSet{Threshold: 1}
 	}
 
 	// simplify quorum set if needed
-	if qSet.Threshold == 1 && len(v) == 0 && len(iS) == 1 {
+	if res.Threshold == 1 && len(res.Validators) == 0 && len(res.InnerSets) == 1 {
+		res = res.InnerSets[0]
+	}
+	return res
+}
+
+// removes repeated nodes, keeping the first occurrence
+func dedupNodeIDs(nodes []types.NodeID) []types.NodeID {
+	var res []types.NodeID
+	for _, n := range nodes {
+		index := SliceIndex(len(res), func(i int) bool { return CompareNodeID(res[i], n) == 0 })
+		if index == -1 {
+			res = append(res, n)
+		}
+	}
+	return res
+}
 
-		//t := qSet.InnerSets[len(qSet.InnerSets)-1]
-		// or t := qSet.InnerSets[0] ?
-		*qSet = iS[0]
+// called recursively, sorts qSet in place
+func normalizeQSetReorder(qSet *types.SCPQuorumSet) {
+	v := qSet.Validators
+	sort.Slice(v, func(i, j int) bool { return CompareNodeID(v[i], v[j]) < 0 })
+
+	iS := qSet.InnerSets
+	for i := range iS {
+		normalizeQSetReorder(&iS[i])
+	}
+	sort.Slice(iS, func(i, j int) bool { return compareQSet(iS[i], iS[j]) < 0 })
+}
+
+// nodeKey identifies a node by value: NodeIDs hold their key through a
+// pointer, so equal IDs decoded separately differ with == and as map keys
+type nodeKey struct {
+	keyType types.PublicKeyType
+	null    bool // no key
+	key     types.Uint256
+}
+
+func keyOf(nodeID types.NodeID) nodeKey {
+	if nodeID.Ed25519 == nil {
+		return nodeKey{keyType: nodeID.Type, null: true}
+	}
+	return nodeKey{keyType: nodeID.Type, key: *nodeID.Ed25519}
+}
+
+// CompareNodeID orders nodes by key type then by key bytes
+func CompareNodeID(a types.NodeID, b types.NodeID) int {
+	if a.Type != b.Type {
+		if a.Type < b.Type {
+			return -1
+		}
+		return 1
+	}
+	switch {
+	case a.Ed25519 == b.Ed25519:
+		return 0
+	case a.Ed25519 == nil:
+		return -1
+	case b.Ed25519 == nil:
+		return 1
+	}
+	return bytes.Compare(a.Ed25519[:], b.Ed25519[:])
+}
+
+// compares validators, then inner sets, then threshold
+func compareQSet(a types.SCPQuorumSet, b types.SCPQuorumSet) int {
+	for i := 0; i < len(a.Validators) && i < len(b.Validators); i++ {
+		if c := CompareNodeID(a.Validators[i], b.Validators[i]); c != 0 {
+			return c
+		}
+	}
+	if len(a.Validators) != len(b.Validators) {
+		if len(a.Validators) < len(b.Validators) {
+			return -1
+		}
+		return 1
+	}
+	for i := 0; i < len(a.InnerSets) && i < len(b.InnerSets); i++ {
+		if c := compareQSet(a.InnerSets[i], b.InnerSets[i]); c != 0 {
+			return c
+		}
+	}
+	if len(a.InnerSets) != len(b.InnerSets) {
+		if len(a.InnerSets) < len(b.InnerSets) {
+			return -1
+		}
+		return 1
+	}
+	switch {
+	case a.Threshold < b.Threshold:
+		return -1
+	case a.Threshold > b.Threshold:
+		return 1
 	}
+	return 0
 }
@@ -0,0 +1,131 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scp
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/scp/types"
+)
+
+// distinctQSet returns a quorum set of at most 3 levels, each node of pool
+// appears at most once and thresholds go from 1 to one above the number
+// of entries, so some sets can never be satisfied
+func distinctQSet(r *rand.Rand, pool *[]byte, depth int) types.SCPQuorumSet {
+	var qSet types.SCPQuorumSet
+	for i := r.Intn(3); i > 0 && len(*pool) != 0; i-- {
+		qSet.Validators = append(qSet.Validators, testNodeID((*pool)[0]))
+		*pool = (*pool)[1:]
+	}
+	if depth < 2 {
+		for i := r.Intn(3); i > 0; i-- {
+			qSet.InnerSets = append(qSet.InnerSets, distinctQSet(r, pool, depth+1))
+		}
+	}
+	qSet.Threshold = uint32(1 + r.Intn(len(qSet.Validators)+len(qSet.InnerSets)+1))
+	return qSet
+}
+
+// nodeSubset returns the nodes of pool selected by mask
+func nodeSubset(pool []byte, mask int) []types.NodeID {
+	var res []types.NodeID
+	for i, b := range pool {
+		if mask&(1<<uint(i)) != 0 {
+			res = append(res, testNodeID(b))
+		}
+	}
+	return res
+}
+
+func TestNormalizeQSetKeepsUnsatisfiable(t *testing.T) {
+	a := testNodeID(1)
+	empty := types.SCPQuorumSet{Threshold: 1}
+	tests := []struct {
+		name string
+		qSet types.SCPQuorumSet
+	}{
+		{"empty inner set", types.SCPQuorumSet{
+			Threshold: 2, Validators: []types.NodeID{a}, InnerSets: []types.SCPQuorumSet{empty}}},
+		{"threshold above the entries", types.SCPQuorumSet{
+			Threshold: 2, Validators: []types.NodeID{a}}},
+		{"nested", types.SCPQuorumSet{
+			Threshold: 1, InnerSets: []types.SCPQuorumSet{{
+				Threshold: 2, Validators: []types.NodeID{a}, InnerSets: []types.SCPQuorumSet{empty}}}}},
+	}
+	for _, tt := range tests {
+		norm := NormalizeQSet(tt.qSet, nil)
+		if IsQuorumSlice(norm, []types.NodeID{testNodeID(1)}) {
+			t.Errorf("%s: normalized set %+v is satisfied", tt.name, norm)
+		}
+	}
+}
+
+func TestNormalizeQSetKeepsSlices(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for c := 0; c < 5000; c++ {
+		pool := []byte{1, 2, 3, 4, 5, 6}
+		left := append([]byte{}, pool...)
+		qSet := distinctQSet(r, &left, 0)
+		removed := testNodeID(pool[r.Intn(len(pool))])
+
+		norm := NormalizeQSet(qSet, nil)
+		normRemoved := NormalizeQSet(qSet, &removed)
+		for mask := 0; mask < 1<<uint(len(pool)); mask++ {
+			nodeSet := nodeSubset(pool, mask)
+			want := IsQuorumSlice(qSet, nodeSet)
+			if got := IsQuorumSlice(norm, nodeSet); got != want {
+				t.Fatalf("case %d: %+v normalized into %+v, slice %v: got %v want %v",
+					c, qSet, norm, mask, got, want)
+			}
+			// the removed node always agrees
+			want = IsQuorumSlice(qSet, append(nodeSet, removed))
+			// a threshold lowered to 0 needs no one
+			got := normRemoved.Threshold == 0 || IsQuorumSlice(normRemoved, nodeSet)
+			if got != want {
+				t.Fatalf("case %d: %+v normalized without %v into %+v, slice %v: got %v want %v",
+					c, qSet, removed.Ed25519[0], normRemoved, mask, got, want)
+			}
+		}
+	}
+}
+
+func TestIsQuorumSetSaneRepeatedNodes(t *testing.T) {
+	// each testNodeID call allocates its own copy of the key
+	tests := []struct {
+		name string
+		qSet types.SCPQuorumSet
+	}{
+		{"validators", flatQSet(2, 1, 1)},
+		{"nested", types.SCPQuorumSet{
+			Threshold:  2,
+			Validators: []types.NodeID{testNodeID(1)},
+			InnerSets:  []types.SCPQuorumSet{flatQSet(1, 2, 1)}}},
+	}
+	for _, tt := range tests {
+		if IsQuorumSetSane(tt.qSet, false) {
+			t.Errorf("%s: %+v is sane", tt.name, tt.qSet)
+		}
+	}
+	if !IsQuorumSetSane(flatQSet(2, 1, 2), false) {
+		t.Error("distinct nodes are not sane")
+	}
+}
@@ -23,34 +23,655 @@
 package scp
 
 import (
-	"log"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/scp/types"
 )
 
+// SCP is not safe for concurrent use: all its methods must be called from
+// the goroutine that drives it
 type SCP struct {
 	mDriver    SCPDriver
 	mLocalNode *LocalNode
+
+	// Slots indexed by slot index
+	mKnownSlots map[uint64]*Slot
+
+	// channels waiting for a slot to externalize, by slot index
+	mExternalizeWaiters map[uint64][]chan interface{}
+	// the slots below were purged
+	mPurgedBelow uint64
+
+	// quorum sets referenced by statements, the local ones are pinned
+	mQSetCache QuorumSetCache
+
+	// envelopes waiting for their quorum set or values
+	mPendingEnvelopes pendingEnvelopes
+
+	// number of statements rejected by isStatementSane, by reason
+	mInsaneStatements map[StatementRejection]uint64
+
+	// where the envelopes of the local node are persisted, nil if they
+	// aren't
+	mEnvelopeStore EnvelopeStore
 }
 
 func (ns *SCP) nSCP(driver SCPDriver, nodeID types.NodeID, isValidator bool,
 	qSetLocal types.SCPQuorumSet) {
 	ns.mDriver = driver
+	ns.mLocalNode = &LocalNode{}
 	ns.mLocalNode.NLocalNode(nodeID, isValidator, qSetLocal, ns)
+	ns.mKnownSlots = make(map[uint64]*Slot)
+	ns.mExternalizeWaiters = make(map[uint64][]chan interface{})
+
+	ns.mQSetCache.NQuorumSetCache(defaultQSetCacheSize)
+	ns.mQSetCache.Pin(ns.mLocalNode.QuorumSet())
+	ns.mQSetCache.Pin(*ns.mLocalNode.mSingleQSet)
+
+	ns.mPendingEnvelopes.NPendingEnvelopes(defaultPendingExpirySlots)
+	ns.mInsaneStatements = make(map[StatementRejection]uint64)
 }
 
+// ErrInvalidSignature is returned for an envelope the driver can't verify
+var ErrInvalidSignature = errors.New("SCP: envelope signature is not valid")
+
+// ErrInvalidValue is returned for a statement with a value the driver
+// rejects
+var ErrInvalidValue = errors.New("SCP: statement value is not valid")
+
+// ErrEquivocation is returned for a statement that contradicts one its
+// node sent before
+var ErrEquivocation = errors.New("SCP: node equivocated")
+
+// envelopes for slots further ahead of the highest known slot are
+// rejected, parked ones included
+const maxSlotsAhead uint64 = 100
+
+// ErrSlotTooFarAhead is returned for an envelope whose slot is more than
+// maxSlotsAhead above the highest known slot
+var ErrSlotTooFarAhead = errors.New("SCP: envelope for a slot too far ahead")
+
+// ErrPendingEnvelopeRefused is returned for an envelope that can't be
+// parked, too many envelopes are parked
+var ErrPendingEnvelopeRefused = errors.New("SCP: envelope can't be parked")
+
 // this is the main entry point of the SCP library
 // it processes the envelope, updates the internal state and
 // invokes the appropriate methods
-func (ns *SCP) receiveEnvelope(envelope types.SCPEnvelope) EnvelopeState {
+// Invalid comes with the reason of the rejection: an *InsaneStatementError
+// for malformed statements, or one of the Err values above.
+func (ns *SCP) receiveEnvelope(envelope types.SCPEnvelope) (EnvelopeState, error) {
+	ns.mDriver.incCounter(MetricEnvelopesReceived)
+	return ns.receiveEnvelopeInternal(envelope)
+}
+
+// receiveEnvelopeInternal is receiveEnvelope for the envelopes received
+// before, parked ones are processed again with it. Pending is not an
+// outcome: a parked envelope is counted once processed, or once dropped.
+func (ns *SCP) receiveEnvelopeInternal(envelope types.SCPEnvelope) (EnvelopeState, error) {
+	res, err := ns.processReceivedEnvelope(envelope)
+	switch res {
+	case Valid:
+		ns.mDriver.incCounter(MetricEnvelopesValid)
+	case Invalid:
+		ns.mDriver.incCounter(MetricEnvelopesInvalid)
+	case Stale:
+		ns.mDriver.incCounter(MetricEnvelopesStale)
+	}
+	return res, err
+}
+
+func (ns *SCP) processReceivedEnvelope(envelope types.SCPEnvelope) (EnvelopeState, error) {
 	// If the envelope is not correctly signed, we ignore it.
 	if !ns.mDriver.verifyEnvelope(envelope) {
-		log.Println("DEBUG SCP: receiveEnvelope invalid")
-		return Invalid
+		ns.mDriver.log(LogLevelDebug, "receiveEnvelope invalid signature",
+			Field("slot", envelope.Statement.SlotIndex),
+			Field("node", toShortString(envelope.Statement.NodeID)))
+		return Invalid, ErrInvalidSignature
+	}
+	st := envelope.Statement
+	slotIndex := st.SlotIndex
+
+	if !ns.empty() && slotIndex > ns.getHighSlotIndex()+maxSlotsAhead {
+		ns.mDriver.log(LogLevelDebug, "receiveEnvelope slot too far ahead",
+			Field("slot", slotIndex), Field("node", toShortString(st.NodeID)))
+		return Invalid, ErrSlotTooFarAhead
+	}
+	if slotIndex < ns.mPurgedBelow {
+		return Stale, nil
+	}
+
+	// wait for what the statement depends on before processing it, the
+	// checks that don't need it are done first
+	if missing := ns.getMissingDependencies(st); len(missing) != 0 {
+		if err := isStatementWellFormed(st, false); err != nil {
+			ns.mDriver.log(LogLevelDebug, "receiveEnvelope insane statement",
+				Field("slot", slotIndex), Field("node", toShortString(st.NodeID)), Field("error", err))
+			ns.countInsaneStatement(err)
+			return Invalid, err
+		}
+		if slot := ns.getSlot(slotIndex, false); slot != nil && !slot.isNewerStatement(st) {
+			return Stale, nil
+		}
+		if ns.mPendingEnvelopes.has(envelope) {
+			// a duplicate
+			return Stale, nil
+		}
+		parked, evicted := ns.mPendingEnvelopes.park(envelope, missing)
+		ns.countDroppedEnvelopes(evicted)
+		if !parked {
+			ns.mDriver.log(LogLevelDebug, "receiveEnvelope can't park",
+				Field("slot", slotIndex), Field("node", toShortString(st.NodeID)))
+			return Invalid, ErrPendingEnvelopeRefused
+		}
+		ns.mDriver.log(LogLevelDebug, "receiveEnvelope parked",
+			Field("slot", slotIndex), Field("node", toShortString(st.NodeID)),
+			Field("missing", len(missing)))
+		ns.countDroppedEnvelopes(ns.mPendingEnvelopes.expire(ns.getHighSlotIndex(), 0))
+		return Pending, nil
+	}
+
+	// a new slot is only kept if the envelope is accepted
+	slot := ns.getSlot(slotIndex, false)
+	if slot == nil {
+		slot = ns.newSlot(slotIndex)
+	}
+	res, validationRes, err := slot.checkEnvelope(envelope, false)
+	if res == Valid {
+		ns.mKnownSlots[slotIndex] = slot
+		slot.applyEnvelope(envelope, false, validationRes)
+	}
+	ns.countDroppedEnvelopes(ns.mPendingEnvelopes.expire(ns.getHighSlotIndex(), 0))
+	return res, err
+}
+
+// getMissingDependencies returns the hashes of the quorum set and of the
+// value data st needs that are not available
+func (ns *SCP) getMissingDependencies(st types.SCPStatement) []types.Hash {
+	var res []types.Hash
+	if st.Type != types.SCPStExternalize {
+		// EXTERNALIZE statements only depend on their node
+		h := getCompanionQuorumSetHashFromStatement(st)
+		if ns.getQSet(h) == nil {
+			res = append(res, h)
+		}
+	}
+	for _, v := range getStatementValues(st) {
+		res = append(res, ns.mDriver.missingValueData(st.SlotIndex, v)...)
+	}
+	return res
+}
+
+// dependencyReceived must be called once the data behind h (a quorum set
+// or value data) is available, the envelopes waiting on it are processed
+// again
+func (ns *SCP) dependencyReceived(h types.Hash) {
+	for _, envelope := range ns.mPendingEnvelopes.received(h) {
+		ns.receiveEnvelopeInternal(envelope)
+	}
+}
+
+// setPendingEnvelopesExpiry sets after how many slots parked envelopes
+// are dropped
+func (ns *SCP) setPendingEnvelopesExpiry(slots uint64) {
+	ns.mPendingEnvelopes.mExpirySlots = slots
+}
+
+// getPendingEnvelopesCount returns the number of parked envelopes
+func (ns *SCP) getPendingEnvelopesCount() int {
+	return ns.mPendingEnvelopes.count()
+}
+
+// updateLocalQuorumSet changes the quorum set of the local node for the
+// slots from fromSlot on, see LocalNode.UpdateQuorumSet
+func (ns *SCP) updateLocalQuorumSet(qSet types.SCPQuorumSet, fromSlot uint64) error {
+	old := append([]qSetChange{}, ns.mLocalNode.mQSetChanges...)
+	if err := ns.mLocalNode.UpdateQuorumSet(qSet, fromSlot); err != nil {
+		return err
+	}
+	// statements for the slots from fromSlot on refer to the new set
+	newQSet, _ := ns.mLocalNode.QuorumSetForSlot(fromSlot)
+	ns.mQSetCache.Pin(newQSet)
+	// the changes scheduled after fromSlot were replaced
+	ns.unpinLocalQuorumSets(old)
+	return nil
+}
+
+// unpinLocalQuorumSets releases the quorum sets of the changes in old the
+// local node doesn't use anymore
+func (ns *SCP) unpinLocalQuorumSets(old []qSetChange) {
+	for _, c := range old {
+		if !ns.mLocalNode.usesQuorumSet(c.qSetHash) && c.qSetHash != ns.mLocalNode.gSingleQSetHash {
+			ns.mQSetCache.Unpin(c.qSetHash)
+		}
+	}
+}
+
+// getQSet returns the quorum set for qSetHash, asking the driver if it's
+// not in the cache. nil is returned if the driver doesn't know it either,
+// it should then fetch it and hand it over with receiveQuorumSet.
+func (ns *SCP) getQSet(qSetHash types.Hash) *types.SCPQuorumSet {
+	if qSet := ns.mQSetCache.Get(qSetHash); qSet != nil {
+		return qSet
+	}
+	qSet := ns.mDriver.getQSet(qSetHash)
+	if qSet == nil {
+		return nil
+	}
+	if QSetHash(*qSet) != qSetHash {
+		ns.mDriver.log(LogLevelError, "getQSet driver returned a quorum set for another hash",
+			Field("qSet", hexAbbrev(qSetHash)))
+		return nil
+	}
+	ns.mQSetCache.Add(*qSet)
+	return qSet
+}
+
+// receiveQuorumSet stores a quorum set fetched from the network, the
+// envelopes waiting for it are processed again. It returns its hash, or
+// ErrInsaneQuorumSet if the set fails the sanity checks.
+func (ns *SCP) receiveQuorumSet(qSet types.SCPQuorumSet) (types.Hash, error) {
+	if !IsQuorumSetSane(qSet, false) {
+		ns.mDriver.log(LogLevelDebug, "receiveQuorumSet insane quorum set",
+			Field("qSet", hexAbbrev(QSetHash(qSet))))
+		return types.Hash{}, ErrInsaneQuorumSet
+	}
+	h := ns.mQSetCache.Add(qSet)
+	ns.dependencyReceived(h)
+	return h, nil
+}
+
+// emitEnvelope signs an envelope of the local node, processes it as the
+// latest statement of the local node and broadcasts it. With a store, the
+// envelope is persisted between the checks and the change of state, so
+// that the state never gets ahead of what a restart restores.
+// Watchers (non validators) never do, false is returned then, as well as
+// when the slot rejects the envelope or it can't be persisted.
+func (ns *SCP) emitEnvelope(envelope types.SCPEnvelope) bool {
+	if !ns.mLocalNode.IsValidator() {
+		ns.mDriver.log(LogLevelDebug, "emitEnvelope skipped, watcher node",
+			Field("slot", envelope.Statement.SlotIndex))
+		return false
+	}
+	ns.mDriver.signEnvelope(&envelope)
+
+	slot := ns.getSlot(envelope.Statement.SlotIndex, true)
+	res, validationRes, err := slot.checkEnvelope(envelope, true)
+	if res != Valid {
+		ns.mDriver.log(LogLevelError, "emitEnvelope rejected",
+			Field("slot", envelope.Statement.SlotIndex), Field("state", res), Field("error", err))
+		return false
+	}
+	// once emitted, the envelope must survive a restart
+	if ns.mEnvelopeStore != nil {
+		if err := ns.mEnvelopeStore.Append(envelope); err != nil {
+			ns.mDriver.log(LogLevelError, "emitEnvelope can't persist",
+				Field("slot", envelope.Statement.SlotIndex), Field("error", err))
+			return false
+		}
+	}
+	slot.applyEnvelope(envelope, true, validationRes)
+	slot.recordMessageSend(envelope)
+
+	ns.mDriver.emitEnvelope(envelope)
+	return true
+}
+
+// setEnvelopeStore makes SCP persist the envelopes of the local node in
+// store before emitting them. The local state is first restored from the
+// latest nomination and ballot envelopes of each slot held by store, it is
+// meant to be called on startup.
+func (ns *SCP) setEnvelopeStore(store EnvelopeStore) error {
+	envelopes, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	type slotEnvelopes struct {
+		nomination *types.SCPEnvelope
+		ballot     *types.SCPEnvelope
+	}
+	latest := make(map[uint64]*slotEnvelopes)
+	var slotIndexes []uint64
+	for i := range envelopes {
+		e := &envelopes[i]
+		slotIndex := e.Statement.SlotIndex
+		l, exist := latest[slotIndex]
+		if !exist {
+			l = &slotEnvelopes{}
+			latest[slotIndex] = l
+			slotIndexes = append(slotIndexes, slotIndex)
+		}
+		// envelopes were appended as they were emitted, the last one of
+		// each kind is the newest
+		if e.Statement.Type == types.SCPStNominate {
+			l.nomination = e
+		} else {
+			l.ballot = e
+		}
+	}
+
+	for _, slotIndex := range slotIndexes {
+		l := latest[slotIndex]
+		for _, e := range []*types.SCPEnvelope{l.nomination, l.ballot} {
+			if e == nil {
+				continue
+			}
+			if err := ns.setStateFromEnvelope(slotIndex, *e); err != nil {
+				return err
+			}
+		}
+	}
+	ns.mEnvelopeStore = store
+	return nil
+}
+
+// getLatestMessagesSend returns the latest nomination and ballot envelopes
+// the local node emitted for slotIndex, used to rebroadcast them. Nothing
+// is returned if the slot is not fully validated.
+func (ns *SCP) getLatestMessagesSend(slotIndex uint64) []types.SCPEnvelope {
+	if slot := ns.getSlot(slotIndex, false); slot != nil {
+		return slot.getLatestMessagesSend()
+	}
+	return []types.SCPEnvelope{}
+}
+
+// getCurrentState returns the latest envelope of each node for slotIndex,
+// nominations first
+func (ns *SCP) getCurrentState(slotIndex uint64) []types.SCPEnvelope {
+	if slot := ns.getSlot(slotIndex, false); slot != nil {
+		return slot.getCurrentState()
+	}
+	return []types.SCPEnvelope{}
+}
+
+// getExternalizingState returns, once slotIndex externalized, the latest
+// ballot envelopes that agree with the externalized value
+func (ns *SCP) getExternalizingState(slotIndex uint64) []types.SCPEnvelope {
+	if slot := ns.getSlot(slotIndex, false); slot != nil {
+		return slot.getExternalizingState()
+	}
+	return []types.SCPEnvelope{}
+}
+
+// getEquivocations returns the evidence collected against the nodes that
+// equivocated on slotIndex
+func (ns *SCP) getEquivocations(slotIndex uint64) []Equivocation {
+	if slot := ns.getSlot(slotIndex, false); slot != nil {
+		return slot.getEquivocations()
+	}
+	return []Equivocation{}
+}
+
+// setStateFromEnvelope restores the state of slotIndex from an envelope the
+// local node emitted before a restart (its latest nomination or ballot
+// envelope), without emitting it again
+func (ns *SCP) setStateFromEnvelope(slotIndex uint64, e types.SCPEnvelope) error {
+	return ns.getSlot(slotIndex, true).setStateFromEnvelope(e)
+}
+
+// getSlot returns the slot for slotIndex, it is created if create is set
+// and the slot is not known yet, nil is returned otherwise
+func (ns *SCP) getSlot(slotIndex uint64, create bool) *Slot {
+	slot, exist := ns.mKnownSlots[slotIndex]
+	if !exist && create {
+		slot = ns.newSlot(slotIndex)
+		ns.mKnownSlots[slotIndex] = slot
+	}
+	return slot
+}
+
+// newSlot returns a slot for slotIndex that ns doesn't know yet
+func (ns *SCP) newSlot(slotIndex uint64) *Slot {
+	slot := &Slot{}
+	slot.NSlot(slotIndex, ns)
+	return slot
+}
+
+// purgeSlots forgets all the slots below maxSlotIndex
+// the channels still waiting on them are closed, the local quorum sets
+// only they used are unpinned
+func (ns *SCP) purgeSlots(maxSlotIndex uint64) {
+	if maxSlotIndex > ns.mPurgedBelow {
+		ns.mPurgedBelow = maxSlotIndex
+	}
+	for slotIndex := range ns.mKnownSlots {
+		if slotIndex < maxSlotIndex {
+			delete(ns.mKnownSlots, slotIndex)
+		}
+	}
+	old := append([]qSetChange{}, ns.mLocalNode.mQSetChanges...)
+	ns.mLocalNode.purgeQuorumSets(maxSlotIndex)
+	ns.unpinLocalQuorumSets(old)
+	ns.countDroppedEnvelopes(ns.mPendingEnvelopes.expire(ns.getHighSlotIndex(), maxSlotIndex))
+	if ns.mEnvelopeStore != nil {
+		if err := ns.mEnvelopeStore.Truncate(maxSlotIndex); err != nil {
+			ns.mDriver.log(LogLevelError, "purgeSlots can't truncate the envelope store",
+				Field("slot", maxSlotIndex), Field("error", err))
+		}
+	}
+	for slotIndex, waiters := range ns.mExternalizeWaiters {
+		if slotIndex < maxSlotIndex {
+			for _, c := range waiters {
+				close(c)
+			}
+			delete(ns.mExternalizeWaiters, slotIndex)
+		}
+	}
+}
+
+// nominationTimerExpired is called by the driver when the nomination timer
+// of slotIndex fires: the next nomination round starts, the driver arms
+// its timer again with computeTimeout of the new round number
+func (ns *SCP) nominationTimerExpired(slotIndex uint64) {
+	ns.mDriver.incCounter(MetricTimeouts)
+	slot := ns.getSlot(slotIndex, false)
+	if slot == nil || !slot.mNominationProtocol.mNominationStarted {
+		ns.mDriver.log(LogLevelDebug, "nominationTimerExpired slot not nominating",
+			Field("slot", slotIndex))
+		return
+	}
+	slot.mNominationProtocol.startRound()
+	ns.mDriver.log(LogLevelDebug, "nominationTimerExpired",
+		Field("slot", slotIndex), Field("round", slot.mNominationProtocol.mRoundNumber))
+}
+
+// ballotTimerExpired is called by the driver when the ballot timer of
+// slotIndex fires, the driver then emits a ballot with a higher counter
+func (ns *SCP) ballotTimerExpired(slotIndex uint64) {
+	ns.mDriver.incCounter(MetricTimeouts)
+	ns.mDriver.log(LogLevelDebug, "ballotTimerExpired", Field("slot", slotIndex))
+}
+
+// externalizedValue returns a channel that receives the value
+// externalized by slotIndex, right away if it is already known.
+// The channel is closed once the value is sent, or without any value if
+// the slot is purged before it externalizes or was already purged.
+// Like the other methods it must be called from the goroutine driving SCP,
+// the channel itself can be read from any goroutine.
+func (ns *SCP) externalizedValue(slotIndex uint64) <-chan interface{} {
+	c := make(chan interface{}, 1)
+	if slot := ns.getSlot(slotIndex, false); slot != nil && slot.mExternalized {
+		c <- slot.mExternalizedValue
+		close(c)
+		return c
+	}
+	if slotIndex < ns.mPurgedBelow {
+		close(c)
+		return c
+	}
+	ns.mExternalizeWaiters[slotIndex] = append(ns.mExternalizeWaiters[slotIndex], c)
+	return c
+}
+
+// valueExternalized notifies the driver and the waiting channels that
+// slotIndex externalized value
+func (ns *SCP) valueExternalized(slotIndex uint64, value interface{}) {
+	ns.mDriver.valueExternalized(slotIndex, value)
+
+	for _, c := range ns.mExternalizeWaiters[slotIndex] {
+		c <- value
+		close(c)
+	}
+	delete(ns.mExternalizeWaiters, slotIndex)
+}
+
+// isSlotFullyValidated returns true if the slot is known and all the values
+// it saw were fully validated
+func (ns *SCP) isSlotFullyValidated(slotIndex uint64) bool {
+	slot := ns.getSlot(slotIndex, false)
+	if slot == nil {
+		return false
+	}
+	return slot.isFullyValidated()
+}
+
+// empty tells if no slot is known
+func (ns *SCP) empty() bool {
+	return len(ns.mKnownSlots) == 0
+}
+
+// getHighSlotIndex returns the highest known slot index, 0 if none
+func (ns *SCP) getHighSlotIndex() uint64 {
+	var res uint64
+	for slotIndex := range ns.mKnownSlots {
+		if slotIndex > res {
+			res = slotIndex
+		}
+	}
+	return res
+}
+
+// getLowSlotIndex returns the lowest known slot index, 0 if none
+func (ns *SCP) getLowSlotIndex() uint64 {
+	var res uint64
+	first := true
+	for slotIndex := range ns.mKnownSlots {
+		if first || slotIndex < res {
+			res = slotIndex
+			first = false
+		}
+	}
+	return res
+}
+
+// getKnownSlotsCount returns the number of slots held
+func (ns *SCP) getKnownSlotsCount() int {
+	return len(ns.mKnownSlots)
+}
+
+// countDroppedEnvelopes counts parked envelopes dropped before being
+// processed
+func (ns *SCP) countDroppedEnvelopes(n int) {
+	for i := 0; i < n; i++ {
+		ns.mDriver.incCounter(MetricEnvelopesDropped)
+	}
+}
+
+// countInsaneStatement counts a rejection returned by isStatementSane
+func (ns *SCP) countInsaneStatement(err error) {
+	if e, ok := err.(*InsaneStatementError); ok {
+		ns.mInsaneStatements[e.Reason]++
+	}
+}
+
+// getInsaneStatementCounts returns how many statements were rejected as
+// malformed, by reason
+func (ns *SCP) getInsaneStatementCounts() map[StatementRejection]uint64 {
+	res := make(map[StatementRejection]uint64)
+	for reason, count := range ns.mInsaneStatements {
+		res[reason] = count
+	}
+	return res
+}
+
+// getStatementsHistoryJson dumps as JSON the statements slotIndex
+// processed, "null" if the slot is not known
+func (ns *SCP) getStatementsHistoryJson(slotIndex uint64) string {
+	var history []HistoricalStatementJson
+	if slot := ns.getSlot(slotIndex, false); slot != nil {
+		history = slot.getJsonHistory()
+	}
+	fw, err := json.Marshal(history)
+	if err != nil {
+		ns.mDriver.log(LogLevelError, "getStatementsHistoryJson", Field("error", err))
+	}
+	return string(fw)
+}
+
+// getJsonInfo dumps as JSON the state of the limit most recent slots (all
+// of them if limit is negative), newest first
+func (ns *SCP) getJsonInfo(limit int) string {
+	slotIndexes := make([]uint64, 0, len(ns.mKnownSlots))
+	for slotIndex := range ns.mKnownSlots {
+		slotIndexes = append(slotIndexes, slotIndex)
+	}
+	sort.Slice(slotIndexes, func(i, j int) bool { return slotIndexes[i] > slotIndexes[j] })
+	if limit >= 0 && len(slotIndexes) > limit {
+		slotIndexes = slotIndexes[:limit]
+	}
+
+	res := make([]SlotJsonInfo, 0, len(slotIndexes))
+	for _, slotIndex := range slotIndexes {
+		res = append(res, ns.mKnownSlots[slotIndex].getJsonInfo())
+	}
+	fw, err := json.Marshal(res)
+	if err != nil {
+		ns.mDriver.log(LogLevelError, "getJsonInfo", Field("error", err))
+	}
+	return string(fw)
+}
+
+func ballotToStr(ballot *types.SCPBallot) string {
+	if ballot == nil {
+		return "(<null_ballot>)"
+	}
+	return fmt.Sprintf("(%d,%s)", ballot.Counter, getValueString(ballot.Value))
+}
+
+func hexAbbrev(hash types.Hash) string {
+	return hex.EncodeToString(hash[:types.HexAbbrev])
+}
+
+// envToStr returns a readable description of st, used for debugging
+func (ns *SCP) envToStr(st types.SCPStatement) string {
+	var b strings.Builder
+	qSetHash := getCompanionQuorumSetHashFromStatement(st)
+
+	fmt.Fprintf(&b, "{ENV@%s |  i: %d", toShortString(st.NodeID), st.SlotIndex)
+	switch st.Type {
+	case types.SCPStPrepare:
+		p := &st.SCPStPrepare
+		fmt.Fprintf(&b, " | PREPARE | D: %s | b: %s | p: %s | p': %s | c.n: %d | h.n: %d",
+			hexAbbrev(qSetHash), ballotToStr(&p.Ballot), ballotToStr(p.Prepared),
+			ballotToStr(p.PreparedPrime), p.NC, p.NH)
+	case types.SCPStConfirm:
+		c := &st.SCPStConfirm
+		fmt.Fprintf(&b, " | CONFIRM | D: %s | b: %s | p.n: %d | c.n: %d | h.n: %d",
+			hexAbbrev(qSetHash), ballotToStr(&c.Ballot), c.NPrepared, c.NCommit, c.NH)
+	case types.SCPStExternalize:
+		ex := &st.SCPStExternalize
+		fmt.Fprintf(&b, " | EXTERNALIZE | c: %s | h.n: %d | (lastD): %s",
+			ballotToStr(&ex.Commit), ex.NH, hexAbbrev(qSetHash))
+	case types.SCPStNominate:
+		nom := &st.SCPStNominate
+		fmt.Fprintf(&b, " | NOMINATE | D: %s | X: {", hexAbbrev(qSetHash))
+		for _, v := range nom.Votes {
+			fmt.Fprintf(&b, " '%s',", getValueString(v))
+		}
+		b.WriteString("} | Y: {")
+		for _, a := range nom.Accepted {
+			fmt.Fprintf(&b, " '%s',", getValueString(a))
+		}
+		b.WriteString("}")
 	}
-	//slotIndex := envelope.Statement.SlotIndex
-	//TODO create function for return
-	return Valid
+	b.WriteString(" }")
+	return b.String()
 }
 
 //enum
@@ -59,11 +680,15 @@ type EnvelopeState int32
 const (
 	Invalid EnvelopeState = iota
 	Valid
+	Pending // parked until its dependencies are received
+	Stale   // not newer than the latest statement from its node
 )
 
 var envelopeStateMap = map[int32]string{
 	0: "Invalid",
 	1: "Valid",
+	2: "Pending",
+	3: "Stale",
 }
 
 // ValidEnum validates a proposed value for this enum.  Implements
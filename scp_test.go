@@ -0,0 +1,146 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scp
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/scp/types"
+)
+
+// newTestSCP returns a SCP for node 0, whose quorum set is itself
+func newTestSCP(validator bool) *SCP {
+	s := &SCP{}
+	self := testNodeID(0)
+	s.nSCP(SCPDriver{}, self, validator, types.SCPQuorumSet{Threshold: 1, Validators: []types.NodeID{self}})
+	return s
+}
+
+// testPrepare returns a PREPARE envelope of node 1 for ballot (counter, "v")
+func testPrepare(s *SCP, slotIndex uint64, counter uint32) types.SCPEnvelope {
+	var e types.SCPEnvelope
+	e.Statement.NodeID = testNodeID(1)
+	e.Statement.SlotIndex = slotIndex
+	e.Statement.SCPStPrepare.QuorumSetHash = s.mLocalNode.QuorumSetHash()
+	e.Statement.SCPStPrepare.Ballot = types.SCPBallot{Counter: counter, Value: "v"}
+	return e
+}
+
+func TestReceiveEnvelopeCreatesSlotOnlyIfAccepted(t *testing.T) {
+	s := newTestSCP(true)
+	s.mDriver.ValidateValue = func(uint64, interface{}, bool) ValidationLevel { return FullyValidatedValue }
+	if res, err := s.receiveEnvelope(testPrepare(s, 1, 1)); res != Valid {
+		t.Fatalf("got %v (%v), want valid", res, err)
+	}
+
+	// a ballot counter of 0 is malformed
+	for _, slotIndex := range []uint64{2, 1 << 40} {
+		if res, _ := s.receiveEnvelope(testPrepare(s, slotIndex, 0)); res != Invalid {
+			t.Fatalf("slot %d: got %v, want invalid", slotIndex, res)
+		}
+		if s.getSlot(slotIndex, false) != nil {
+			t.Fatalf("slot %d created by an invalid envelope", slotIndex)
+		}
+	}
+	if high := s.getHighSlotIndex(); high != 1 {
+		t.Fatalf("got high slot %d, want 1", high)
+	}
+	if err := s.updateLocalQuorumSet(types.SCPQuorumSet{Threshold: 1, Validators: []types.NodeID{testNodeID(0)}}, 2); err != nil {
+		t.Fatalf("can't update the quorum set: %v", err)
+	}
+
+	far := 1 + maxSlotsAhead + 1
+	if res, err := s.receiveEnvelope(testPrepare(s, far, 1)); res != Invalid || err != ErrSlotTooFarAhead {
+		t.Fatalf("got %v (%v), want %v", res, err, ErrSlotTooFarAhead)
+	}
+	if res, err := s.receiveEnvelope(testPrepare(s, far-1, 1)); res != Valid {
+		t.Fatalf("got %v (%v), want valid", res, err)
+	}
+	if high := s.getHighSlotIndex(); high != far-1 {
+		t.Fatalf("got high slot %d, want %d", high, far-1)
+	}
+}
+
+func TestSetEnvelopeStoreRestoresState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "envelopes")
+	fullyValidated := func(uint64, interface{}, bool) ValidationLevel { return FullyValidatedValue }
+
+	s := newTestSCP(true)
+	s.mDriver.ValidateValue = fullyValidated
+	if err := s.setEnvelopeStore(openTestStore(t, path)); err != nil {
+		t.Fatal(err)
+	}
+	var nomination types.SCPEnvelope
+	nomination.Statement.NodeID = s.mLocalNode.NodeID()
+	nomination.Statement.SlotIndex = 3
+	nomination.Statement.Type = types.SCPStNominate
+	nomination.Statement.SCPStNominate.QuorumSetHash = s.mLocalNode.QuorumSetHash()
+	nomination.Statement.SCPStNominate.Votes = []interface{}{"v"}
+	var emitted []types.SCPEnvelope
+	emitted = append(emitted, nomination)
+	for counter := uint32(1); counter <= 2; counter++ {
+		ballot := testPrepare(s, 3, counter)
+		ballot.Statement.NodeID = s.mLocalNode.NodeID()
+		emitted = append(emitted, ballot)
+	}
+	for _, e := range emitted {
+		if !s.emitEnvelope(e) {
+			t.Fatalf("envelope %+v not emitted", e.Statement)
+		}
+	}
+	s.mEnvelopeStore.Close()
+
+	// restart
+	s = newTestSCP(true)
+	s.mDriver.ValidateValue = fullyValidated
+	store := openTestStore(t, path)
+	defer store.Close()
+	if err := s.setEnvelopeStore(store); err != nil {
+		t.Fatal(err)
+	}
+	slot := s.getSlot(3, false)
+	if slot == nil {
+		t.Fatal("slot not restored")
+	}
+	if b := slot.mBallotProtocol.mCurrentBallot; b == nil || b.Counter != 2 {
+		t.Fatalf("got ballot %+v, want counter 2", b)
+	}
+	if votes := slot.mNominationProtocol.mVotes; len(votes) != 1 || votes[0] != "v" {
+		t.Fatalf("got votes %v, want [v]", votes)
+	}
+	// the latest envelopes are sent again as they were
+	sent := s.getLatestMessagesSend(3)
+	want := []types.SCPEnvelope{emitted[0], emitted[2]}
+	if len(sent) != len(want) {
+		t.Fatalf("got %d envelopes to send, want %d", len(sent), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(types.Pack(sent[i]), types.Pack(want[i])) {
+			t.Fatalf("envelope %d differs", i)
+		}
+	}
+	// the local node can't go back on what it emitted
+	if s.emitEnvelope(emitted[1]) {
+		t.Fatal("older ballot emitted after the restart")
+	}
+}
@@ -35,7 +35,58 @@ import (
 // protocol.
 
 //virtual
-type SCPDriver struct{}
+// The optional function fields below are the overridable methods, the
+// default behavior applies when they are not set.
+type SCPDriver struct {
+	// ValueExternalized is notified when a slot externalizes its value
+	ValueExternalized func(slotIndex uint64, value interface{})
+	// ValidateValue overrides validateValue
+	ValidateValue func(slotIndex uint64, value interface{}, nomination bool) ValidationLevel
+	// SignEnvelope overrides signEnvelope
+	SignEnvelope func(envelope *types.SCPEnvelope)
+	// VerifyEnvelope overrides verifyEnvelope
+	VerifyEnvelope func(envelope types.SCPEnvelope) bool
+	// EmitEnvelope overrides emitEnvelope
+	EmitEnvelope func(envelope types.SCPEnvelope)
+	// GetQSet overrides getQSet
+	GetQSet func(qSetHash types.Hash) *types.SCPQuorumSet
+	// MissingValueData overrides missingValueData
+	MissingValueData func(slotIndex uint64, value interface{}) []types.Hash
+	// EquivocationDetected is notified when a node contradicts itself
+	EquivocationDetected func(evidence Equivocation)
+	// Logger receives the logs of SCP, they are dropped if nil
+	Logger Logger
+	// Metrics receives the measures of SCP, they are dropped if nil
+	Metrics Metrics
+}
+
+//enum
+type ValidationLevel int32
+
+const (
+	InvalidValue        ValidationLevel = iota // value is invalid
+	MaybeValidValue                            // value may be valid, it can't be fully checked
+	FullyValidatedValue                        // value is valid for sure
+)
+
+var validationLevelMap = map[int32]string{
+	0: "InvalidValue",
+	1: "MaybeValidValue",
+	2: "FullyValidatedValue",
+}
+
+// ValidEnum validates a proposed value for this enum.  Implements
+// the Enum interface for ValidationLevel
+func (e ValidationLevel) ValidEnum(v int32) bool {
+	_, ok := validationLevelMap[v]
+	return ok
+}
+
+// String returns the name of `e`
+func (e ValidationLevel) String() string {
+	name, _ := validationLevelMap[int32(e)]
+	return name
+}
 
 // `getValueString` is used for debugging
 // default implementation is the hash of the value
@@ -45,11 +96,13 @@ func getValueString(value interface{}) string {
 	return hex.EncodeToString(valueHash[:])[:types.HexAbbrev]
 }
 
-// `toShortString` converts to the common name of a key if found
+// `toShortString` converts a key to its abbreviated hex form, used for
+// debugging
 func toShortString(pk types.PublicKey) string {
-	//TODO strKey(key)
-	//return string(pk)[:types.StringAbbrev]
-	return "key"
+	if pk.Ed25519 == nil {
+		return "<null_key>"
+	}
+	return hex.EncodeToString(pk.Ed25519[:])[:types.StrAbbrev]
 }
 
 // values used to switch hash function between priority and neighborhood checks
@@ -80,6 +133,93 @@ func computeTimeout(roundNumber uint32) int64 {
 	return int64(timeoutInSeconds * 1000)
 }
 
+// `log` sends a record to the driver's logger
+func (nD *SCPDriver) log(level LogLevel, msg string, fields ...LogField) {
+	logWith(nD.Logger, level, msg, fields...)
+}
+
+// `incCounter` and `observe` send a measure to the driver's metrics
+func (nD *SCPDriver) incCounter(name string) {
+	if nD.Metrics != nil {
+		nD.Metrics.IncCounter(name)
+	}
+}
+
+func (nD *SCPDriver) observe(name string, value float64) {
+	if nD.Metrics != nil {
+		nD.Metrics.Observe(name, value)
+	}
+}
+
+// `verifyEnvelope` checks the signature of an envelope, without a
+// VerifyEnvelope hook all envelopes pass
 func (nD *SCPDriver) verifyEnvelope(envelope types.SCPEnvelope) bool {
+	if nD.VerifyEnvelope != nil {
+		return nD.VerifyEnvelope(envelope)
+	}
 	return true
 }
+
+// `valueExternalized` is called at most once per slot when the slot
+// externalizes its value.
+func (nD *SCPDriver) valueExternalized(slotIndex uint64, value interface{}) {
+	if nD.ValueExternalized != nil {
+		nD.ValueExternalized(slotIndex, value)
+	}
+}
+
+// `validateValue` is called on each message received before any processing
+// is done. It should be used to filter out values that are not compatible
+// with the current state of that node. Unvalidated values can never
+// externalize.
+// If the value cannot be validated (node is not in sync), it's safe to
+// return MaybeValidValue, the slot is then no longer fully validated.
+// nomination is set when the value comes from a nomination statement.
+func (nD *SCPDriver) validateValue(slotIndex uint64, value interface{}, nomination bool) ValidationLevel {
+	if nD.ValidateValue != nil {
+		return nD.ValidateValue(slotIndex, value, nomination)
+	}
+	return MaybeValidValue
+}
+
+// `signEnvelope` signs the envelope of a statement of the local node
+func (nD *SCPDriver) signEnvelope(envelope *types.SCPEnvelope) {
+	if nD.SignEnvelope != nil {
+		nD.SignEnvelope(envelope)
+	}
+}
+
+// `emitEnvelope` delivers a signed envelope of the local node to the
+// network
+func (nD *SCPDriver) emitEnvelope(envelope types.SCPEnvelope) {
+	if nD.EmitEnvelope != nil {
+		nD.EmitEnvelope(envelope)
+	}
+}
+
+// `getQSet` returns the quorum set for a given hash, nil if it's not known
+func (nD *SCPDriver) getQSet(qSetHash types.Hash) *types.SCPQuorumSet {
+	if nD.GetQSet != nil {
+		return nD.GetQSet(qSetHash)
+	}
+	return nil
+}
+
+// `missingValueData` returns the hashes of the data value refers to (such
+// as a transaction set) that is not available yet. The driver should fetch
+// it and report it with SCP.dependencyReceived.
+func (nD *SCPDriver) missingValueData(slotIndex uint64, value interface{}) []types.Hash {
+	if nD.MissingValueData != nil {
+		return nD.MissingValueData(slotIndex, value)
+	}
+	return nil
+}
+
+// `equivocationDetected` is called at most once per node and slot when the
+// node sends contradictory statements, evidence holds both signed envelopes.
+// The application may alert on or ban the node.
+func (nD *SCPDriver) equivocationDetected(evidence Equivocation) {
+	if nD.EquivocationDetected != nil {
+		nD.EquivocationDetected(evidence)
+	}
+}
@@ -23,6 +23,9 @@
 package scp
 
 import (
+	"bytes"
+	"errors"
+	"sort"
 	"time"
 
 	"github.com/scp/types"
@@ -35,11 +38,33 @@ import (
 
 type Slot struct {
 	mSlotIndex uint64
-	mSCP       SCP
-	//mBallotProtocol     BallotProtocol
-	//mNominationProtocol NominationProtocol
+	mSCP       *SCP
+
+	mBallotProtocol     BallotProtocol
+	mNominationProtocol NominationProtocol
+
 	mStatementsHistory []HistoricalStatement
 	mFullyValidated    bool
+
+	// when the slot was created, to measure the time it takes to
+	// externalize
+	mCreated time.Time
+
+	// value the slot externalized, set at most once
+	mExternalized      bool
+	mExternalizedValue interface{}
+
+	// latest envelope received from each node, for ballot statements
+	// (PREPARE, CONFIRM, EXTERNALIZE) and for NOMINATE ones
+	mLatestEnvelopes   map[nodeKey]types.SCPEnvelope
+	mLatestNominations map[nodeKey]types.SCPEnvelope
+
+	// latest envelopes emitted by the local node
+	mLastNominationSend *types.SCPEnvelope
+	mLastBallotSend     *types.SCPEnvelope
+
+	// evidence against the nodes that equivocated on this slot
+	mEquivocations map[nodeKey]Equivocation
 }
 
 // keeps track of all statements seen so far for this slot.
@@ -50,10 +75,429 @@ type HistoricalStatement struct {
 	mValidated bool
 }
 
-func (ns *Slot) NSlot(slotIndex uint64, scp SCP) {
+// HistoricalStatementJson is the JSON view of a HistoricalStatement
+type HistoricalStatementJson struct {
+	When      time.Time `json:"when"`
+	Validated bool      `json:"validated"`
+	Statement string    `json:"statement"`
+}
+
+// SlotJsonInfo is the JSON view of the state of a slot
+type SlotJsonInfo struct {
+	Index      uint64              `json:"index"`
+	Validated  bool                `json:"validated"`
+	Nomination NominationJsonInfo  `json:"nomination"`
+	Ballot     BallotJsonInfo      `json:"ballotProtocol"`
+	Statements []NodeStatementJson `json:"statements"`
+}
+
+// NodeStatementJson is the latest statement of a node, the nodes are
+// rendered with toShortString
+type NodeStatementJson struct {
+	Node      string `json:"node"`
+	Statement string `json:"statement"`
+}
+
+func (ns *Slot) NSlot(slotIndex uint64, scp *SCP) {
 	ns.mSlotIndex = slotIndex
 	ns.mSCP = scp
-	//ns.mBallotProtocol(*ns)
-	//ns.mNominationProtocol(*ns)
-	//ns.mFullyValidated = scp.getLocalNode.isValidator
+	ns.mCreated = time.Now()
+	ns.mBallotProtocol.NBallotProtocol(ns)
+	ns.mNominationProtocol.NNominationProtocol(ns)
+	ns.mFullyValidated = scp.mLocalNode.IsValidator()
+	ns.mLatestEnvelopes = make(map[nodeKey]types.SCPEnvelope)
+	ns.mLatestNominations = make(map[nodeKey]types.SCPEnvelope)
+	ns.mEquivocations = make(map[nodeKey]Equivocation)
+}
+
+func (ns *Slot) getSlotIndex() uint64 {
+	return ns.mSlotIndex
+}
+
+// getLocalQuorumSet returns the quorum set of the local node for this slot
+func (ns *Slot) getLocalQuorumSet() types.SCPQuorumSet {
+	qSet, _ := ns.mSCP.mLocalNode.QuorumSetForSlot(ns.mSlotIndex)
+	return qSet
+}
+
+func (ns *Slot) isFullyValidated() bool {
+	return ns.mFullyValidated
+}
+
+func (ns *Slot) setFullyValidated(fullyValidated bool) {
+	ns.mFullyValidated = fullyValidated
+}
+
+// externalize records that the slot externalized value, only the first
+// call has an effect
+func (ns *Slot) externalize(value interface{}) {
+	if ns.mExternalized {
+		return
+	}
+	ns.mExternalized = true
+	ns.mExternalizedValue = value
+	ns.mSCP.mDriver.observe(MetricTimeToExternalize, time.Since(ns.mCreated).Seconds())
+	ns.mSCP.valueExternalized(ns.mSlotIndex, value)
+}
+
+// getExternalizedValue returns the value of the slot if it externalized
+func (ns *Slot) getExternalizedValue() (interface{}, bool) {
+	return ns.mExternalizedValue, ns.mExternalized
+}
+
+// checkEnvelope tells if envelope can be processed, and how well its values
+// validated, without changing the state of the slot (evidence of
+// equivocation aside). self is set for the statements emitted by the local
+// node. Invalid comes with the reason of the rejection.
+func (ns *Slot) checkEnvelope(envelope types.SCPEnvelope, self bool) (EnvelopeState, ValidationLevel, error) {
+	st := envelope.Statement
+
+	if err := ns.isStatementSane(st, self); err != nil {
+		ns.mSCP.mDriver.log(LogLevelDebug, "checkEnvelope insane statement",
+			Field("slot", ns.mSlotIndex), Field("node", toShortString(st.NodeID)), Field("error", err))
+		ns.mSCP.countInsaneStatement(err)
+		return Invalid, InvalidValue, err
+	}
+	if !self {
+		if ev := ns.checkEquivocation(envelope); ev != nil {
+			ns.mSCP.mDriver.log(LogLevelError, "checkEnvelope equivocation",
+				Field("slot", ns.mSlotIndex), Field("node", toShortString(st.NodeID)), Field("kind", ev.Kind))
+			return Invalid, InvalidValue, ErrEquivocation
+		}
+	}
+	if !ns.isNewerStatement(st) {
+		// stale or duplicate statement
+		return Stale, InvalidValue, nil
+	}
+
+	validationRes := ns.validateValues(st)
+	if validationRes == InvalidValue {
+		ns.mSCP.mDriver.log(LogLevelDebug, "checkEnvelope invalid value",
+			Field("slot", ns.mSlotIndex), Field("node", toShortString(st.NodeID)))
+		return Invalid, InvalidValue, ErrInvalidValue
+	}
+	return Valid, validationRes, nil
+}
+
+// applyEnvelope makes envelope, accepted by checkEnvelope, the latest
+// statement of its node
+func (ns *Slot) applyEnvelope(envelope types.SCPEnvelope, self bool, validationRes ValidationLevel) {
+	st := envelope.Statement
+	if validationRes != FullyValidatedValue {
+		// we can't be sure of the values we accept from now on
+		ns.setFullyValidated(false)
+	}
+
+	ns.recordStatement(st)
+	if self {
+		// the statements of the local node are its state
+		if st.Type == types.SCPStNominate {
+			if !ns.mNominationProtocol.mNominationStarted {
+				ns.mNominationProtocol.startRound()
+			}
+			ns.mNominationProtocol.setLocalState(st)
+			ns.mNominationProtocol.mNominationStarted = true
+		} else {
+			ns.mBallotProtocol.setLocalBallotState(st)
+		}
+	}
+	if st.Type == types.SCPStNominate {
+		ns.mLatestNominations[keyOf(st.NodeID)] = envelope
+	} else {
+		ns.mLatestEnvelopes[keyOf(st.NodeID)] = envelope
+		ns.mBallotProtocol.checkHeardFromQuorum()
+		ns.checkExternalize()
+	}
+}
+
+// getQuorumSetFromStatement returns the quorum set the node of st uses,
+// nil if it's not known.
+// A node that externalized only depends on itself from then on.
+func (ns *Slot) getQuorumSetFromStatement(st types.SCPStatement) *types.SCPQuorumSet {
+	if st.Type == types.SCPStExternalize {
+		return SingletonQSet(st.NodeID)
+	}
+	return ns.mSCP.getQSet(getCompanionQuorumSetHashFromStatement(st))
+}
+
+// checkExternalize externalizes the slot once a quorum accepted to commit
+// the same ballot, this only relies on the statements of the other nodes
+// so that watchers follow the validators
+func (ns *Slot) checkExternalize() {
+	if ns.mExternalized {
+		return
+	}
+
+	localQSet := ns.getLocalQuorumSet()
+	qFun := func(st types.SCPStatement) *types.SCPQuorumSet {
+		return ns.getQuorumSetFromStatement(st)
+	}
+	latest := envelopesByNodeID(ns.mLatestEnvelopes)
+
+	// intervals of accepted commits that overlap share the highest of
+	// their lower bounds, so only those need to be tried
+	for _, e := range ns.mLatestEnvelopes {
+		candidate, ok := getAcceptedCommit(e.Statement)
+		if !ok {
+			continue
+		}
+		filter := func(st types.SCPStatement) bool {
+			return hasAcceptedCommit(st, candidate)
+		}
+		if IsQuorum(localQSet, latest, qFun, filter) {
+			ns.externalize(candidate.Value)
+			return
+		}
+	}
+}
+
+// getAcceptedCommit returns the lowest ballot st accepted to commit
+func getAcceptedCommit(st types.SCPStatement) (types.SCPBallot, bool) {
+	switch st.Type {
+	case types.SCPStConfirm:
+		return types.SCPBallot{Counter: st.SCPStConfirm.NCommit, Value: st.SCPStConfirm.Ballot.Value}, true
+	case types.SCPStExternalize:
+		return st.SCPStExternalize.Commit, true
+	}
+	return types.SCPBallot{}, false
+}
+
+// hasAcceptedCommit tells if st accepted to commit ballot
+func hasAcceptedCommit(st types.SCPStatement, ballot types.SCPBallot) bool {
+	switch st.Type {
+	case types.SCPStConfirm:
+		c := &st.SCPStConfirm
+		return compareValues(c.Ballot.Value, ballot.Value) == 0 &&
+			c.NCommit <= ballot.Counter && ballot.Counter <= c.NH
+	case types.SCPStExternalize:
+		ex := &st.SCPStExternalize
+		return compareValues(ex.Commit.Value, ballot.Value) == 0 &&
+			ex.Commit.Counter <= ballot.Counter
+	}
+	return false
+}
+
+// compareValues orders values by their encoding
+func compareValues(a interface{}, b interface{}) int {
+	return bytes.Compare(types.Pack(a), types.Pack(b))
+}
+
+// validateValues returns the lowest validation level of the values of st
+func (ns *Slot) validateValues(st types.SCPStatement) ValidationLevel {
+	values := getStatementValues(st)
+	if len(values) == 0 {
+		// This shouldn't happen
+		return InvalidValue
+	}
+
+	nomination := st.Type == types.SCPStNominate
+	res := FullyValidatedValue
+	for _, v := range values {
+		switch ns.mSCP.mDriver.validateValue(ns.mSlotIndex, v, nomination) {
+		case InvalidValue:
+			return InvalidValue
+		case MaybeValidValue:
+			res = MaybeValidValue
+		}
+	}
+	return res
+}
+
+// getStatementValues returns the values a statement refers to
+func getStatementValues(st types.SCPStatement) []interface{} {
+	switch st.Type {
+	case types.SCPStPrepare:
+		return []interface{}{st.SCPStPrepare.Ballot.Value}
+	case types.SCPStConfirm:
+		return []interface{}{st.SCPStConfirm.Ballot.Value}
+	case types.SCPStExternalize:
+		return []interface{}{st.SCPStExternalize.Commit.Value}
+	case types.SCPStNominate:
+		var res []interface{}
+		res = append(res, st.SCPStNominate.Votes...)
+		res = append(res, st.SCPStNominate.Accepted...)
+		return res
+	}
+	return nil
+}
+
+// recordStatement adds st to the history along with the time it was
+// received and whether the slot was fully validated at that time
+func (ns *Slot) recordStatement(st types.SCPStatement) {
+	ns.mStatementsHistory = append(ns.mStatementsHistory, HistoricalStatement{
+		mWhen:      time.Now(),
+		mStatement: st,
+		mValidated: ns.mFullyValidated,
+	})
+}
+
+// getJsonHistory returns the history of the slot, oldest first
+func (ns *Slot) getJsonHistory() []HistoricalStatementJson {
+	res := make([]HistoricalStatementJson, 0, len(ns.mStatementsHistory))
+	for _, h := range ns.mStatementsHistory {
+		res = append(res, HistoricalStatementJson{
+			When:      h.mWhen,
+			Validated: h.mValidated,
+			Statement: ns.mSCP.envToStr(h.mStatement),
+		})
+	}
+	return res
+}
+
+// getJsonInfo returns the state of the slot, the latest statements are
+// sorted by node
+func (ns *Slot) getJsonInfo() SlotJsonInfo {
+	res := SlotJsonInfo{
+		Index:      ns.mSlotIndex,
+		Validated:  ns.mFullyValidated,
+		Nomination: ns.mNominationProtocol.getJsonInfo(),
+		Ballot:     ns.mBallotProtocol.getJsonInfo(),
+		Statements: []NodeStatementJson{},
+	}
+	// nominations first, then ballot statements
+	for _, latest := range []map[nodeKey]types.SCPEnvelope{ns.mLatestNominations, ns.mLatestEnvelopes} {
+		for _, e := range sortLatest(latest) {
+			res.Statements = append(res.Statements, NodeStatementJson{
+				Node:      toShortString(e.Statement.NodeID),
+				Statement: ns.mSCP.envToStr(e.Statement),
+			})
+		}
+	}
+	return res
+}
+
+// getCompanionQuorumSetHashFromStatement returns the hash of the quorum set
+// that goes along with st
+func getCompanionQuorumSetHashFromStatement(st types.SCPStatement) types.Hash {
+	switch st.Type {
+	case types.SCPStPrepare:
+		return st.SCPStPrepare.QuorumSetHash
+	case types.SCPStConfirm:
+		return st.SCPStConfirm.QuorumSetHash
+	case types.SCPStExternalize:
+		return st.SCPStExternalize.CommitQuorumSetHash
+	case types.SCPStNominate:
+		return st.SCPStNominate.QuorumSetHash
+	}
+	return types.Hash{}
+}
+
+// recordMessageSend keeps envelope as the latest one the local node emitted
+func (ns *Slot) recordMessageSend(envelope types.SCPEnvelope) {
+	if envelope.Statement.Type == types.SCPStNominate {
+		ns.mLastNominationSend = &envelope
+	} else {
+		ns.mLastBallotSend = &envelope
+	}
+}
+
+func (ns *Slot) getLatestMessagesSend() []types.SCPEnvelope {
+	res := []types.SCPEnvelope{}
+	if ns.mFullyValidated {
+		if ns.mLastNominationSend != nil {
+			res = append(res, *ns.mLastNominationSend)
+		}
+		if ns.mLastBallotSend != nil {
+			res = append(res, *ns.mLastBallotSend)
+		}
+	}
+	return res
+}
+
+func (ns *Slot) getCurrentState() []types.SCPEnvelope {
+	res := ns.getLatestFrom(ns.mLatestNominations, nil)
+	return append(res, ns.getLatestFrom(ns.mLatestEnvelopes, nil)...)
+}
+
+func (ns *Slot) getExternalizingState() []types.SCPEnvelope {
+	if !ns.mExternalized {
+		return []types.SCPEnvelope{}
+	}
+	// good approximation: statements with the value that externalized
+	return ns.getLatestFrom(ns.mLatestEnvelopes, func(st types.SCPStatement) bool {
+		return compareValues(getWorkingBallot(st).Value, ns.mExternalizedValue) == 0
+	})
+}
+
+// getLatestFrom returns the envelopes of latest sorted by node, keeping the
+// ones of the other nodes that pass filter (all if nil). The envelope of the
+// local node is only returned if the slot is fully validated.
+func (ns *Slot) getLatestFrom(latest map[nodeKey]types.SCPEnvelope,
+	filter func(types.SCPStatement) bool) []types.SCPEnvelope {
+
+	res := []types.SCPEnvelope{}
+	localKey := keyOf(ns.mSCP.mLocalNode.NodeID())
+	for key, e := range latest {
+		if key == localKey {
+			if !ns.mFullyValidated {
+				continue
+			}
+		} else if filter != nil && !filter(e.Statement) {
+			continue
+		}
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return CompareNodeID(res[i].Statement.NodeID, res[j].Statement.NodeID) < 0
+	})
+	return res
+}
+
+// envelopesByNodeID returns latest keyed by the node IDs of its envelopes,
+// as IsQuorum and IsVBlockingF expect
+func envelopesByNodeID(latest map[nodeKey]types.SCPEnvelope) map[types.NodeID]types.SCPEnvelope {
+	res := make(map[types.NodeID]types.SCPEnvelope, len(latest))
+	for _, e := range latest {
+		res[e.Statement.NodeID] = e
+	}
+	return res
+}
+
+// getWorkingBallot returns the ballot a ballot statement is about
+func getWorkingBallot(st types.SCPStatement) types.SCPBallot {
+	switch st.Type {
+	case types.SCPStConfirm:
+		return st.SCPStConfirm.Ballot
+	case types.SCPStExternalize:
+		return st.SCPStExternalize.Commit
+	}
+	return st.SCPStPrepare.Ballot
+}
+
+// errInvalidRestoreEnvelope is returned by setStateFromEnvelope for an
+// envelope that is not a statement of the local node for the slot
+var errInvalidRestoreEnvelope = errors.New("SCP: Slot setStateFromEnvelope invalid envelope")
+
+// setStateFromEnvelope restores the state of the local node from an
+// envelope it emitted before a restart. The envelope is recorded as its
+// latest one, but it is neither processed nor emitted again.
+func (ns *Slot) setStateFromEnvelope(e types.SCPEnvelope) error {
+	st := e.Statement
+	// compared by value, e was most likely loaded from storage
+	localID := ns.mSCP.mLocalNode.NodeID()
+	if CompareNodeID(st.NodeID, localID) != 0 || st.SlotIndex != ns.mSlotIndex {
+		ns.mSCP.mDriver.log(LogLevelError, "setStateFromEnvelope invalid envelope",
+			Field("slot", ns.mSlotIndex), Field("node", toShortString(st.NodeID)))
+		return errInvalidRestoreEnvelope
+	}
+
+	if st.Type == types.SCPStNominate {
+		if err := ns.mNominationProtocol.setStateFromEnvelope(e); err != nil {
+			return err
+		}
+		ns.mLatestNominations[keyOf(localID)] = e
+	} else {
+		if err := ns.mBallotProtocol.setStateFromEnvelope(e); err != nil {
+			return err
+		}
+		ns.mLatestEnvelopes[keyOf(localID)] = e
+		if st.Type == types.SCPStExternalize {
+			// the application already knows the outcome
+			ns.mExternalized = true
+			ns.mExternalizedValue = st.SCPStExternalize.Commit.Value
+		}
+	}
+	ns.recordStatement(st)
+	ns.recordMessageSend(e)
+	return nil
 }
@@ -0,0 +1,149 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Adapted from C++ code by 2014 Stellar Development Foundation and contributors
+
+package scp
+
+import (
+	"github.com/scp/types"
+)
+
+// IsNewerStatement tells if st, from the same node and slot as oldst,
+// supersedes it.
+//  * nominations only grow: st must hold all the votes and accepted values
+//    of oldst, and at least one more
+//  * ballot statements follow the total order of the SCP paper: by type
+//    (PREPARE < CONFIRM < EXTERNALIZE), then by ballot and counters
+// A nomination and a ballot statement are never ordered.
+func IsNewerStatement(oldst types.SCPStatement, st types.SCPStatement) bool {
+	oldNominate := oldst.Type == types.SCPStNominate
+	nominate := st.Type == types.SCPStNominate
+	switch {
+	case oldNominate && nominate:
+		return isNewerNomination(oldst.SCPStNominate, st.SCPStNominate)
+	case !oldNominate && !nominate:
+		return isNewerBallotStatement(oldst, st)
+	}
+	return false
+}
+
+func isNewerNomination(oldst types.SCPNomination, st types.SCPNomination) bool {
+	grows := false
+	if !isSubsetHelper(oldst.Votes, st.Votes, &grows) {
+		return false
+	}
+	res := grows
+	if !isSubsetHelper(oldst.Accepted, st.Accepted, &grows) {
+		// accepted values can't be removed
+		return false
+	}
+	return res || grows
+}
+
+// isSubsetHelper tells if p \subseteq v, both sorted, notEqual is set if
+// v has more values than p
+func isSubsetHelper(p []interface{}, v []interface{}, notEqual *bool) bool {
+	*notEqual = true
+	if len(p) > len(v) {
+		return false
+	}
+	j := 0
+	for _, x := range p {
+		for j < len(v) && compareValues(v[j], x) < 0 {
+			j++
+		}
+		if j == len(v) || compareValues(v[j], x) != 0 {
+			return false
+		}
+		j++
+	}
+	*notEqual = len(p) != len(v)
+	return true
+}
+
+func isNewerBallotStatement(oldst types.SCPStatement, st types.SCPStatement) bool {
+	// total ordering described in SCP paper.
+	t := st.Type
+
+	// statement type (PREPARE < CONFIRM < EXTERNALIZE)
+	if oldst.Type != t {
+		return oldst.Type < t
+	}
+
+	switch t {
+	case types.SCPStExternalize:
+		// can't have duplicate EXTERNALIZE statements
+		return false
+	case types.SCPStConfirm:
+		// sorted by (b, p, p', h) (p' = 0 implicitly)
+		oldC := &oldst.SCPStConfirm
+		c := &st.SCPStConfirm
+		if compBallot := compareBallots(oldC.Ballot, c.Ballot); compBallot != 0 {
+			return compBallot < 0
+		}
+		if oldC.NPrepared != c.NPrepared {
+			return oldC.NPrepared < c.NPrepared
+		}
+		return oldC.NH < c.NH
+	default:
+		// Lexicographical order between PREPARE statements:
+		// (b, p, p', h)
+		oldPrep := &oldst.SCPStPrepare
+		prep := &st.SCPStPrepare
+		if compBallot := compareBallots(oldPrep.Ballot, prep.Ballot); compBallot != 0 {
+			return compBallot < 0
+		}
+		if compBallot := compareBallotPtrs(oldPrep.Prepared, prep.Prepared); compBallot != 0 {
+			return compBallot < 0
+		}
+		if compBallot := compareBallotPtrs(oldPrep.PreparedPrime, prep.PreparedPrime); compBallot != 0 {
+			return compBallot < 0
+		}
+		return oldPrep.NH < prep.NH
+	}
+}
+
+// compareBallotPtrs is compareBallots where a missing ballot is the lowest
+func compareBallotPtrs(b1 *types.SCPBallot, b2 *types.SCPBallot) int {
+	switch {
+	case b1 == nil && b2 == nil:
+		return 0
+	case b1 == nil:
+		return -1
+	case b2 == nil:
+		return 1
+	}
+	return compareBallots(*b1, *b2)
+}
+
+// isNewerStatement tells if st supersedes the latest statement of the same
+// kind (nomination or ballot) received from its node for this slot
+func (ns *Slot) isNewerStatement(st types.SCPStatement) bool {
+	latest := ns.mLatestEnvelopes
+	if st.Type == types.SCPStNominate {
+		latest = ns.mLatestNominations
+	}
+	old, exist := latest[keyOf(st.NodeID)]
+	if !exist {
+		return true
+	}
+	return IsNewerStatement(old.Statement, st)
+}
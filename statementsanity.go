@@ -0,0 +1,214 @@
+// Copyright (c) 2018 Aidos Developer
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Adapted from C++ code by 2014 Stellar Development Foundation and contributors
+
+package scp
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/scp/types"
+)
+
+//enum
+type StatementRejection int32
+
+const (
+	RejectUnknownQuorumSet StatementRejection = iota
+	RejectInsaneQuorumSet
+	RejectUnknownType
+	RejectPrepareCounter       // b.n is 0
+	RejectPreparedPrime        // p' is not below and incompatible with p
+	RejectPrepareHighCounter   // h.n is above p.n
+	RejectPrepareCommitCounter // c.n <= h.n <= b.n doesn't hold
+	RejectConfirmCounters      // b.n is 0 or c.n <= h.n <= b.n doesn't hold
+	RejectExternalizeCounters  // c.n is 0 or above h.n
+	RejectEmptyNomination      // no votes nor accepted values
+	RejectUnsortedVotes        // votes are not sorted nor unique
+	RejectUnsortedAccepted     // accepted values are not sorted nor unique
+	RejectEmptyValue
+)
+
+var statementRejectionMap = map[int32]string{
+	0:  "RejectUnknownQuorumSet",
+	1:  "RejectInsaneQuorumSet",
+	2:  "RejectUnknownType",
+	3:  "RejectPrepareCounter",
+	4:  "RejectPreparedPrime",
+	5:  "RejectPrepareHighCounter",
+	6:  "RejectPrepareCommitCounter",
+	7:  "RejectConfirmCounters",
+	8:  "RejectExternalizeCounters",
+	9:  "RejectEmptyNomination",
+	10: "RejectUnsortedVotes",
+	11: "RejectUnsortedAccepted",
+	12: "RejectEmptyValue",
+}
+
+// ValidEnum validates a proposed value for this enum.  Implements
+// the Enum interface for StatementRejection
+func (e StatementRejection) ValidEnum(v int32) bool {
+	_, ok := statementRejectionMap[v]
+	return ok
+}
+
+// String returns the name of `e`
+func (e StatementRejection) String() string {
+	name, _ := statementRejectionMap[int32(e)]
+	return name
+}
+
+// InsaneStatementError is returned for a malformed statement
+type InsaneStatementError struct {
+	Reason    StatementRejection
+	NodeID    types.NodeID
+	SlotIndex uint64
+	Type      types.SCPStatementType
+}
+
+func (e *InsaneStatementError) Error() string {
+	return fmt.Sprintf("SCP: insane %s statement from %s for slot %d: %s",
+		e.Type, toShortString(e.NodeID), e.SlotIndex, e.Reason)
+}
+
+func insaneStatement(st types.SCPStatement, reason StatementRejection) error {
+	return &InsaneStatementError{
+		Reason:    reason,
+		NodeID:    st.NodeID,
+		SlotIndex: st.SlotIndex,
+		Type:      st.Type,
+	}
+}
+
+// isStatementSane checks that st is well formed, self is set for the
+// statements of the local node. It returns an *InsaneStatementError if not.
+func (ns *Slot) isStatementSane(st types.SCPStatement, self bool) error {
+	qSet := ns.getQuorumSetFromStatement(st)
+	if qSet == nil {
+		return insaneStatement(st, RejectUnknownQuorumSet)
+	}
+	if !IsQuorumSetSane(*qSet, false) {
+		return insaneStatement(st, RejectInsaneQuorumSet)
+	}
+	return isStatementWellFormed(st, self)
+}
+
+// isStatementWellFormed is isStatementSane without the checks of the
+// quorum set, for the statements whose quorum set is not known yet
+func isStatementWellFormed(st types.SCPStatement, self bool) error {
+	for _, v := range getStatementValues(st) {
+		if isEmptyValue(v) {
+			return insaneStatement(st, RejectEmptyValue)
+		}
+	}
+
+	switch st.Type {
+	case types.SCPStPrepare:
+		p := &st.SCPStPrepare
+		// self is allowed to have b = 0 (as long as it never gets emitted)
+		if !self && p.Ballot.Counter == 0 {
+			return insaneStatement(st, RejectPrepareCounter)
+		}
+		if p.PreparedPrime != nil && p.Prepared != nil &&
+			!areBallotsLessAndIncompatible(*p.PreparedPrime, *p.Prepared) {
+			return insaneStatement(st, RejectPreparedPrime)
+		}
+		if p.NH != 0 && (p.Prepared == nil || p.NH > p.Prepared.Counter) {
+			return insaneStatement(st, RejectPrepareHighCounter)
+		}
+		// c != 0 -> c <= h <= b
+		if p.NC != 0 && (p.NH == 0 || p.Ballot.Counter < p.NH || p.NH < p.NC) {
+			return insaneStatement(st, RejectPrepareCommitCounter)
+		}
+	case types.SCPStConfirm:
+		c := &st.SCPStConfirm
+		// c <= h <= b
+		if c.Ballot.Counter == 0 || c.NH > c.Ballot.Counter || c.NCommit > c.NH {
+			return insaneStatement(st, RejectConfirmCounters)
+		}
+	case types.SCPStExternalize:
+		e := &st.SCPStExternalize
+		if e.Commit.Counter == 0 || e.NH < e.Commit.Counter {
+			return insaneStatement(st, RejectExternalizeCounters)
+		}
+	case types.SCPStNominate:
+		nom := &st.SCPStNominate
+		if len(nom.Votes)+len(nom.Accepted) == 0 {
+			return insaneStatement(st, RejectEmptyNomination)
+		}
+		if !isSortedUnique(nom.Votes) {
+			return insaneStatement(st, RejectUnsortedVotes)
+		}
+		if !isSortedUnique(nom.Accepted) {
+			return insaneStatement(st, RejectUnsortedAccepted)
+		}
+	default:
+		return insaneStatement(st, RejectUnknownType)
+	}
+	return nil
+}
+
+// compareBallots orders ballots by counter then by value
+func compareBallots(b1 types.SCPBallot, b2 types.SCPBallot) int {
+	switch {
+	case b1.Counter < b2.Counter:
+		return -1
+	case b1.Counter > b2.Counter:
+		return 1
+	}
+	return compareValues(b1.Value, b2.Value)
+}
+
+// areBallotsCompatible tells if two ballots have the same value
+func areBallotsCompatible(b1 types.SCPBallot, b2 types.SCPBallot) bool {
+	return compareValues(b1.Value, b2.Value) == 0
+}
+
+// areBallotsLessAndIncompatible tells if b1 < b2 and b1 ~ b2 doesn't hold
+func areBallotsLessAndIncompatible(b1 types.SCPBallot, b2 types.SCPBallot) bool {
+	return compareBallots(b1, b2) < 0 && !areBallotsCompatible(b1, b2)
+}
+
+// isSortedUnique tells if values are strictly increasing
+func isSortedUnique(values []interface{}) bool {
+	for i := 1; i < len(values); i++ {
+		if compareValues(values[i-1], values[i]) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isEmptyValue tells if v is nil or an empty string, slice or map
+func isEmptyValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	r := reflect.ValueOf(v)
+	switch r.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return r.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return r.IsNil()
+	}
+	return false
+}
@@ -27,8 +27,8 @@ package types
 // }
 
 type SCPBallot struct {
-	counter uint32      // n
-	value   interface{} // x
+	Counter uint32      // n
+	Value   interface{} // x
 }
 
 type SCPStatementType int32
@@ -61,38 +61,39 @@ func (e SCPStatementType) String() string {
 }
 
 type SCPNomination struct {
-	quorumSetHash Hash          // D
-	votes         []interface{} // X
-	accepted      []interface{} // Y
+	QuorumSetHash Hash          // D
+	Votes         []interface{} // X
+	Accepted      []interface{} // Y
 }
 
+// SCPStatement holds the pledges of NodeID for SlotIndex, only the pledge
+// selected by Type is meaningful
 type SCPStatement struct {
-	NodeID    NodeID // v
-	SlotIndex uint64 // i
+	NodeID    NodeID           // v
+	SlotIndex uint64           // i
+	Type      SCPStatementType // pledges
 
 	SCPStPrepare struct {
-		quorumSetHash Hash       // D
-		ballot        SCPBallot  // b
-		prepared      *SCPBallot // p
-		preparedPrime *SCPBallot // p'
-		nC            uint32     // c.n
-		nH            uint32     // h.n
+		QuorumSetHash Hash       // D
+		Ballot        SCPBallot  // b
+		Prepared      *SCPBallot // p
+		PreparedPrime *SCPBallot // p'
+		NC            uint32     // c.n
+		NH            uint32     // h.n
 	}
 	SCPStConfirm struct {
-		ballot        SCPBallot // b
-		nPrepared     uint32    // p.n
-		nCommit       uint32    // c.n
-		nH            uint32    // h.n
-		quorumSetHash Hash      // D
+		Ballot        SCPBallot // b
+		NPrepared     uint32    // p.n
+		NCommit       uint32    // c.n
+		NH            uint32    // h.n
+		QuorumSetHash Hash      // D
 	}
 	SCPStExternalize struct {
-		commit              SCPBallot // c
-		nH                  uint32    // h.n
-		commitQuorumSetHash Hash      // D used before EXTERNALIZE
-	}
-	SCPStNominate struct {
-		nominate SCPNomination
+		Commit              SCPBallot // c
+		NH                  uint32    // h.n
+		CommitQuorumSetHash Hash      // D used before EXTERNALIZE
 	}
+	SCPStNominate SCPNomination
 }
 
 type SCPEnvelope struct {
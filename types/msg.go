@@ -36,9 +36,8 @@ func Pack(dat interface{}) []byte {
 	return buf.Bytes()
 }
 
-//Unpack returns tx from msgpack bin data.
-// func (dat *interface{}) Unpack(dat []byte) error {
-// 	buf := bytes.NewBuffer(dat)
-// 	dec := msgpack.NewDecoder(buf)
-// 	return dec.Decode(dat)
-// }
+// Unpack decodes msgpack data produced by Pack into dat
+func Unpack(data []byte, dat interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	return dec.Decode(dat)
+}